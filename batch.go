@@ -0,0 +1,138 @@
+package pulse
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type BatchOptions struct {
+	//	Max number of entries to collect before flushing (defaults to 100)
+	Size int
+	//	Max time an entry can wait before being flushed (defaults to 10s)
+	Interval time.Duration
+}
+
+// Wraps a writer to collect entries and write them in batches,
+// flushing when either the batch size or the flush interval is reached
+func NewBatchWriter(writer StorageWriter, opts BatchOptions) (*BatchWriter, error) {
+
+	if writer == nil {
+		return nil, errors.New("writer is nil")
+	}
+
+	if opts.Size <= 0 {
+		opts.Size = 100
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+
+	this := &BatchWriter{
+		writer: writer,
+		opts:   opts,
+		done:   make(chan struct{}),
+	}
+
+	this.wg.Add(1)
+	go this.run()
+
+	return this, nil
+}
+
+type BatchWriter struct {
+	writer StorageWriter
+	opts   BatchOptions
+
+	mtx     sync.Mutex
+	entries []UptimeEntry
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Returns wrapped writer TypeID
+func (this *BatchWriter) Type() string {
+	return this.writer.Type()
+}
+
+// Returns wrapped writer version
+func (this *BatchWriter) Version() string {
+	return this.writer.Version()
+}
+
+// Queues a single uptime metric. When the batch is full, it's written right away
+// and the write error is returned to the caller
+func (this *BatchWriter) WriteUptime(ctx context.Context, entry UptimeEntry) error {
+
+	this.mtx.Lock()
+
+	this.entries = append(this.entries, entry)
+	if len(this.entries) < this.opts.Size {
+		this.mtx.Unlock()
+		return nil
+	}
+
+	batch := this.take()
+	this.mtx.Unlock()
+
+	return WriteUptimeBatch(ctx, this.writer, batch)
+}
+
+// Writes all the queued entries
+func (this *BatchWriter) Flush(ctx context.Context) error {
+
+	this.mtx.Lock()
+	batch := this.take()
+	this.mtx.Unlock()
+
+	return WriteUptimeBatch(ctx, this.writer, batch)
+}
+
+// Stops the flush loop and writes the remaining entries
+func (this *BatchWriter) Close() error {
+
+	close(this.done)
+	this.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return this.Flush(ctx)
+}
+
+func (this *BatchWriter) take() []UptimeEntry {
+	batch := this.entries
+	this.entries = nil
+	return batch
+}
+
+func (this *BatchWriter) run() {
+
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(this.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+		case <-this.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := this.Flush(ctx)
+		cancel()
+
+		if err != nil {
+			slog.Error("BATCH: Flush failed",
+				slog.String("writer", this.writer.Type()),
+				slog.String("err", err.Error()))
+		}
+	}
+}
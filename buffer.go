@@ -0,0 +1,497 @@
+package pulse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Max number of spooled entries written in a single batch during replay
+const bufferReplayBatchSize = 500
+
+type BufferOptions struct {
+	//	Spool file location
+	Path string
+	//	Max spool file size in bytes (defaults to 64MB). Entries that don't fit are dropped
+	MaxSize int64
+	//	Initial retry delay (defaults to 5s)
+	MinBackoff time.Duration
+	//	Max retry delay (defaults to 5m)
+	MaxBackoff time.Duration
+}
+
+// Wraps a writer to spool entries that failed to be written with a transient error to a local file,
+// and replays them in timestamp order once the backend is available again. Entries that the backend rejects are dropped
+func NewBufferedWriter(writer StorageWriter, opts BufferOptions) (*BufferedWriter, error) {
+
+	if writer == nil {
+		return nil, errors.New("writer is nil")
+	}
+
+	if opts.Path == "" {
+		return nil, errors.New("buffer path is empty")
+	}
+
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 64 * 1024 * 1024
+	}
+
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 5 * time.Second
+	}
+
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(5*time.Minute, opts.MinBackoff)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(opts.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &BufferedWriter{
+		writer: writer,
+		opts:   opts,
+		file:   file,
+		done:   make(chan struct{}),
+	}
+
+	if err := this.trimPartialLine(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to repair spool file: %v", err)
+	}
+
+	//	pick up whatever was left from the previous run
+	entries, size, err := this.readSpool(0)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read spool file: %v", err)
+	}
+
+	this.pending = len(entries)
+	this.size = size
+
+	if this.pending > 0 {
+		slog.Info("BUFFER: Found spooled entries",
+			slog.String("writer", writer.Type()),
+			slog.Int("count", this.pending))
+	}
+
+	this.wg.Add(1)
+	go this.run()
+
+	return this, nil
+}
+
+type BufferedWriter struct {
+	writer StorageWriter
+	opts   BufferOptions
+
+	mtx     sync.Mutex
+	file    *os.File
+	pending int
+	size    int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Returns wrapped writer TypeID
+func (this *BufferedWriter) Type() string {
+	return this.writer.Type()
+}
+
+// Returns wrapped writer version
+func (this *BufferedWriter) Version() string {
+	return this.writer.Version()
+}
+
+// Returns the number of entries waiting to be replayed
+func (this *BufferedWriter) Pending() int {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	return this.pending
+}
+
+// Writes a single uptime metric, spooling it to disk if the backend fails
+func (this *BufferedWriter) WriteUptime(ctx context.Context, entry UptimeEntry) error {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	return this.writeEntry(ctx, entry)
+}
+
+// Writes multiple uptime metrics, spooling all of them to disk if the backend fails
+func (this *BufferedWriter) WriteUptimeBatch(ctx context.Context, entries []UptimeEntry) error {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	//	a failed batch could leave a part of the entries in the backend,
+	//	so only the drivers that can retry a batch as a whole are allowed to fail it as a whole
+	if !isAtomicBatchWriter(this.writer) {
+
+		var errs []error
+		for _, entry := range entries {
+			errs = append(errs, this.writeEntry(ctx, entry))
+		}
+
+		return errors.Join(errs...)
+	}
+
+	if this.pending == 0 {
+
+		err := WriteUptimeBatch(ctx, this.writer, entries)
+		if err == nil {
+			return nil
+		}
+
+		//	batches are written atomically, so the entries can be retried one by one to only drop the rejected ones
+		if !IsTransientError(err) {
+
+			var errs []error
+			for _, entry := range entries {
+				errs = append(errs, this.writeEntry(ctx, entry))
+			}
+
+			return errors.Join(errs...)
+		}
+
+		slog.Warn("BUFFER: Batch write failed, spooling entries",
+			slog.String("writer", this.writer.Type()),
+			slog.Int("count", len(entries)),
+			slog.String("err", err.Error()))
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		errs = append(errs, this.spool(entry))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Writes an entry or spools it to disk. Must be called with the lock held,
+// otherwise an entry could get written while the ones before it are still being spooled
+func (this *BufferedWriter) writeEntry(ctx context.Context, entry UptimeEntry) error {
+
+	//	entries go straight to the spool while it's not empty, to keep them in order
+	if this.pending == 0 {
+
+		err := this.writer.WriteUptime(ctx, entry)
+		if err == nil {
+			return nil
+		}
+
+		//	retrying a rejected entry would only block the ones queued after it
+		if !IsTransientError(err) {
+			this.logRejected(entry, err)
+			return err
+		}
+
+		slog.Warn("BUFFER: Write failed, spooling entry",
+			slog.String("writer", this.writer.Type()),
+			slog.String("label", entry.Label),
+			slog.String("err", err.Error()))
+	}
+
+	return this.spool(entry)
+}
+
+// Stops the retry loop and closes the spool file. Entries that are still pending are kept on disk
+func (this *BufferedWriter) Close() error {
+
+	close(this.done)
+	this.wg.Wait()
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	return this.file.Close()
+}
+
+func (this *BufferedWriter) spool(entry UptimeEntry) error {
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	if this.size+int64(len(line)) > this.opts.MaxSize {
+		return fmt.Errorf("spool file is full (%d bytes), entry dropped", this.size)
+	}
+
+	if _, err := this.file.Write(line); err != nil {
+		return fmt.Errorf("failed to spool entry: %v", err)
+	}
+
+	this.pending++
+	this.size += int64(len(line))
+
+	return nil
+}
+
+func (this *BufferedWriter) logRejected(entry UptimeEntry, err error) {
+	slog.Error("BUFFER: Entry rejected by the backend, dropping",
+		slog.String("writer", this.writer.Type()),
+		slog.String("label", entry.Label),
+		slog.Time("timestamp", entry.Timestamp),
+		slog.String("err", err.Error()))
+}
+
+func (this *BufferedWriter) run() {
+
+	defer this.wg.Done()
+
+	backoff := this.opts.MinBackoff
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	for {
+
+		select {
+		case <-this.done:
+			return
+		case <-timer.C:
+		}
+
+		if err := this.replay(); err != nil {
+
+			backoff = min(backoff*2, this.opts.MaxBackoff)
+
+			slog.Debug("BUFFER: Replay failed",
+				slog.String("writer", this.writer.Type()),
+				slog.Duration("retry_in", backoff),
+				slog.String("err", err.Error()))
+
+		} else {
+			backoff = this.opts.MinBackoff
+		}
+
+		timer.Reset(backoff)
+	}
+}
+
+// Writes spooled entries to the backend in timestamp order.
+// Entries that couldn't be written are kept in the spool
+func (this *BufferedWriter) replay() error {
+
+	var entries []UptimeEntry
+	var offset int64
+	var err error
+
+	//	the spool is only ever rewritten here, so the part that was read stays the same until the results are committed,
+	//	while new entries can still be appended after the offset in the meantime
+	this.mtx.Lock()
+	if this.pending > 0 {
+		entries, offset, err = this.readSpool(0)
+	}
+	this.mtx.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp.Before(entries[j].Timestamp)
+	})
+
+	//	drivers that can't retry a batch as a whole get the entries one by one
+	chunkSize := 1
+	if isAtomicBatchWriter(this.writer) {
+		chunkSize = bufferReplayBatchSize
+	}
+
+	//	number of entries that are done with, either written or dropped
+	var processed int
+	var dropped int
+	var writeErr error
+
+	//	entries of a rejected chunk are retried one by one to find the ones that are rejected
+	var isolateUntil int
+
+replay:
+	for processed < len(entries) {
+
+		select {
+		case <-this.done:
+			break replay
+		default:
+		}
+
+		size := chunkSize
+		if processed < isolateUntil {
+			size = 1
+		}
+
+		chunk := entries[processed:min(processed+size, len(entries))]
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := WriteUptimeBatch(ctx, this.writer, chunk)
+		cancel()
+
+		switch {
+
+		case err == nil:
+			processed += len(chunk)
+
+		case IsTransientError(err):
+			writeErr = err
+			break replay
+
+		case len(chunk) > 1:
+			isolateUntil = processed + len(chunk)
+
+		default:
+			this.logRejected(chunk[0], err)
+			processed++
+			dropped++
+		}
+	}
+
+	if processed == 0 {
+		return writeErr
+	}
+
+	slog.Info("BUFFER: Replayed spooled entries",
+		slog.String("writer", this.writer.Type()),
+		slog.Int("count", processed-dropped),
+		slog.Int("dropped", dropped),
+		slog.Int("left", len(entries)-processed))
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	appended, _, err := this.readSpool(offset)
+	if err != nil {
+		return fmt.Errorf("failed to read spool file: %v", err)
+	}
+
+	if err := this.rewriteSpool(append(entries[processed:], appended...)); err != nil {
+		return fmt.Errorf("failed to compact spool file: %v", err)
+	}
+
+	return writeErr
+}
+
+// Removes the partially written line that a crash in the middle of a write leaves at the end of the spool.
+// Otherwise the next spooled entry would get appended to it, and both of them would be lost
+func (this *BufferedWriter) trimPartialLine() error {
+
+	data, err := os.ReadFile(this.opts.Path)
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 || data[len(data)-1] == '\n' {
+		return nil
+	}
+
+	size := bytes.LastIndexByte(data, '\n') + 1
+
+	slog.Warn("BUFFER: Truncating a partially written spool entry",
+		slog.String("path", this.opts.Path),
+		slog.Int("bytes", len(data)-size))
+
+	return this.file.Truncate(int64(size))
+}
+
+// Reads spooled entries starting at the offset. Returns the entries and the end offset
+func (this *BufferedWriter) readSpool(offset int64) ([]UptimeEntry, int64, error) {
+
+	file, err := os.Open(this.opts.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var entries []UptimeEntry
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+
+		var entry UptimeEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			//	there's nothing to recover in a line that can't be decoded
+			slog.Warn("BUFFER: Skipping malformed spool entry",
+				slog.String("path", this.opts.Path),
+				slog.String("err", err.Error()))
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, offset + int64(len(data)), scanner.Err()
+}
+
+// Replaces spool contents with the provided entries
+func (this *BufferedWriter) rewriteSpool(entries []UptimeEntry) error {
+
+	var buff bytes.Buffer
+
+	for _, entry := range entries {
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		buff.Write(line)
+		buff.WriteByte('\n')
+	}
+
+	tempPath := this.opts.Path + ".tmp"
+
+	if err := os.WriteFile(tempPath, buff.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempPath, this.opts.Path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(this.opts.Path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	this.file.Close()
+	this.file = file
+	this.pending = len(entries)
+	this.size = int64(buff.Len())
+
+	return nil
+}
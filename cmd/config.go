@@ -73,6 +73,8 @@ type FileConfig struct {
 type FileConfigProbesSecion struct {
 	Http ProbeConfig[pulse.HttpProbeOptions] `yaml:"http" json:"http"`
 	Icmp ProbeConfig[pulse.IcmpProbeOptions] `yaml:"icmp" json:"icmp"`
+	Tcp  ProbeConfig[pulse.TcpProbeOptions]  `yaml:"tcp" json:"tcp"`
+	Dns  ProbeConfig[pulse.DnsProbeOptions]  `yaml:"dns" json:"dns"`
 }
 
 type ProbeConfig[T any] map[string]T
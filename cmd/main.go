@@ -7,6 +7,8 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -63,40 +65,234 @@ func main() {
 	slog.Info("Config location",
 		slog.String("file", *cli.Cfg))
 
-	var storageDriver pulse.StorageWriter
+	var storageWriters []pulse.StorageWriter
+
+	//	removes pushgateway groups of the probes that are no longer in the config
+	var pushgatewayPruner interface {
+		DeleteStaleGroups(ctx context.Context, activeProbes []string) error
+	}
 
 	if val := os.Getenv("TIMESCALE_URL"); val != "" {
-		timescale, err := pulse.NewTimescaleStorage(val)
+
+		opts := pulse.TimescaleOptions{
+			Retention:     os.Getenv("TIMESCALE_RETENTION"),
+			CompressAfter: os.Getenv("TIMESCALE_COMPRESS_AFTER"),
+			ImportLegacy:  os.Getenv("TIMESCALE_IMPORT_V2") == "true",
+			Rollups:       os.Getenv("TIMESCALE_ROLLUPS") == "true",
+		}
+
+		if val := os.Getenv("TIMESCALE_ROLLUP_INTERVAL"); val != "" {
+			if opts.RollupInterval, err = time.ParseDuration(val); err != nil {
+				slog.Error("Invalid TIMESCALE_ROLLUP_INTERVAL value",
+					slog.String("value", val))
+				os.Exit(1)
+			}
+		}
+
+		timescale, err := pulse.NewTimescaleStorage(val, opts)
 		if err != nil {
 			slog.Error("Failed to set up timescale storage",
 				slog.String("err", err.Error()))
 			os.Exit(1)
 		}
-		storageDriver = timescale
+		storageWriters = append(storageWriters, timescale)
 		defer timescale.Close()
-	} else if val := os.Getenv("PUSHGATEWAY_URL"); val != "" {
+	}
+
+	if val := os.Getenv("SQLITE_PATH"); val != "" {
+
+		var opts pulse.SqliteOptions
+
+		if val := os.Getenv("SQLITE_RETENTION"); val != "" {
+			if opts.Retention, err = time.ParseDuration(val); err != nil {
+				slog.Error("Invalid SQLITE_RETENTION value",
+					slog.String("value", val))
+				os.Exit(1)
+			}
+		}
+
+		sqlite, err := pulse.NewSqliteStorage(val, opts)
+		if err != nil {
+			slog.Error("Failed to set up sqlite storage",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+		storageWriters = append(storageWriters, sqlite)
+		defer sqlite.Close()
+	}
+
+	if val := os.Getenv("PUSHGATEWAY_URL"); val != "" {
 		pushgateway, err := pulse.NewPushgatewayStorage(val)
 		if err != nil {
 			slog.Error("Failed to set up prometheus push gateway storage",
 				slog.String("err", err.Error()))
 			os.Exit(1)
 		}
-		storageDriver = pushgateway
-	} else if val := os.Getenv("INFLUXDB_URL"); val != "" {
+		storageWriters = append(storageWriters, pushgateway)
+		pushgatewayPruner = pushgateway
+	}
+
+	if val := os.Getenv("INFLUXDB_URL"); val != "" {
 		influx, err := pulse.NewInfluxStorage(val)
 		if err != nil {
 			slog.Error("Failed to set up influxdb storage",
 				slog.String("err", err.Error()))
 			os.Exit(1)
 		}
-		storageDriver = influx
-	} else {
-		storageDriver = &StdoutWriter{}
+		storageWriters = append(storageWriters, influx)
+	}
+
+	if val := os.Getenv("REMOTE_WRITE_URL"); val != "" {
+
+		opts := pulse.RemoteWriteOptions{
+			BearerToken: os.Getenv("REMOTE_WRITE_TOKEN"),
+			Job:         os.Getenv("REMOTE_WRITE_JOB"),
+			Instance:    os.Getenv("REMOTE_WRITE_INSTANCE"),
+		}
+
+		if opts.Instance == "" {
+			opts.Instance, _ = os.Hostname()
+		}
+
+		remoteWrite, err := pulse.NewRemoteWriteStorage(val, opts)
+		if err != nil {
+			slog.Error("Failed to set up prometheus remote write storage",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+		storageWriters = append(storageWriters, remoteWrite)
+		defer remoteWrite.Close()
+	}
+
+	if val := os.Getenv("OTLP_ENDPOINT"); val != "" {
+
+		headers, err := pulse.ParseOtlpKeyValues(os.Getenv("OTLP_HEADERS"))
+		if err != nil {
+			slog.Error("Invalid OTLP_HEADERS value",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+
+		attributes, err := pulse.ParseOtlpKeyValues(os.Getenv("OTLP_RESOURCE_ATTRIBUTES"))
+		if err != nil {
+			slog.Error("Invalid OTLP_RESOURCE_ATTRIBUTES value",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+
+		if _, has := attributes["service.instance.id"]; !has {
+			if hostname, err := os.Hostname(); err == nil {
+				attributes["service.instance.id"] = hostname
+			}
+		}
+
+		otlp, err := pulse.NewOtlpStorage(val, pulse.OtlpOptions{
+			Headers:    headers,
+			Attributes: attributes,
+		})
+		if err != nil {
+			slog.Error("Failed to set up otlp storage",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+		storageWriters = append(storageWriters, otlp)
 	}
 
-	slog.Info("USING STORAGE",
-		slog.String("type", storageDriver.Type()),
-		slog.String("version", storageDriver.Version()))
+	//	each backend gets its own spool so that an outage of one of them doesn't cause duplicates in the others
+	if val := os.Getenv("WRITE_BUFFER_DIR"); val != "" {
+
+		var maxSize int64
+		if val := os.Getenv("WRITE_BUFFER_MAX_MB"); val != "" {
+			size, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || size <= 0 {
+				slog.Error("Invalid WRITE_BUFFER_MAX_MB value",
+					slog.String("value", val))
+				os.Exit(1)
+			}
+			maxSize = size * 1024 * 1024
+		}
+
+		for idx, writer := range storageWriters {
+
+			buffered, err := pulse.NewBufferedWriter(writer, pulse.BufferOptions{
+				Path:    filepath.Join(val, writer.Type()+".spool"),
+				MaxSize: maxSize,
+			})
+			if err != nil {
+				slog.Error("Failed to set up write buffer",
+					slog.String("type", writer.Type()),
+					slog.String("err", err.Error()))
+				os.Exit(1)
+			}
+
+			storageWriters[idx] = buffered
+			defer buffered.Close()
+		}
+	}
+
+	//	the exporter only keeps results in memory and has nothing to buffer
+	if val := os.Getenv("PROMETHEUS_LISTEN"); val != "" {
+		exporter, err := pulse.NewPrometheusExporter(val)
+		if err != nil {
+			slog.Error("Failed to set up prometheus exporter",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+		storageWriters = append(storageWriters, exporter)
+		defer exporter.Close()
+	}
+
+	if len(storageWriters) == 0 {
+		storageWriters = append(storageWriters, &StdoutWriter{})
+	}
+
+	for _, writer := range storageWriters {
+		slog.Info("USING STORAGE",
+			slog.String("type", writer.Type()),
+			slog.String("version", writer.Version()))
+	}
+
+	//	every configured backend gets the entries when there's more than one of them
+	storageDriver := storageWriters[0]
+	if len(storageWriters) > 1 {
+		storageDriver = pulse.NewMultiWriter(storageWriters...)
+	}
+
+	if val := os.Getenv("WRITE_BATCH_SIZE"); val != "" {
+
+		size, err := strconv.Atoi(val)
+		if err != nil || size <= 0 {
+			slog.Error("Invalid WRITE_BATCH_SIZE value",
+				slog.String("value", val))
+			os.Exit(1)
+		}
+
+		var interval time.Duration
+		if val := os.Getenv("WRITE_BATCH_INTERVAL"); val != "" {
+			if interval, err = time.ParseDuration(val); err != nil {
+				slog.Error("Invalid WRITE_BATCH_INTERVAL value",
+					slog.String("value", val))
+				os.Exit(1)
+			}
+		}
+
+		batcher, err := pulse.NewBatchWriter(storageDriver, pulse.BatchOptions{
+			Size:     size,
+			Interval: interval,
+		})
+		if err != nil {
+			slog.Error("Failed to set up write batching",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+
+		slog.Info("Write batching enabled",
+			slog.Int("size", size),
+			slog.Duration("interval", interval))
+
+		storageDriver = batcher
+		defer batcher.Close()
+	}
 
 	probeLabelMap := map[string]int{}
 
@@ -132,6 +328,8 @@ func main() {
 
 	indexLabels(cfg.Probes.Http)
 	indexLabels(cfg.Probes.Icmp)
+	indexLabels(cfg.Probes.Tcp)
+	indexLabels(cfg.Probes.Dns)
 
 	var probes []Probe
 
@@ -185,6 +383,72 @@ func main() {
 		probes = append(probes, &probe)
 	}
 
+	for key, cfg := range cfg.Probes.Tcp {
+
+		dedupProbeKey(&key, "tcp")
+
+		probe := pulse.TcpProbe{
+			Label:           key,
+			Writer:          storageDriver,
+			TcpProbeOptions: cfg,
+		}
+
+		if _, err := probe.Ready(); err != nil {
+			slog.Error("Failed to load tcp probe",
+				slog.String("key", key),
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+
+		slog.Info("Add tcp probe",
+			slog.String("key", key),
+			slog.Duration("interval", probe.TcpProbeOptions.Interval),
+			slog.String("host", probe.TcpProbeOptions.Host))
+
+		probes = append(probes, &probe)
+	}
+
+	for key, cfg := range cfg.Probes.Dns {
+
+		dedupProbeKey(&key, "dns")
+
+		probe := pulse.DnsProbe{
+			Label:           key,
+			Writer:          storageDriver,
+			DnsProbeOptions: cfg,
+		}
+
+		if _, err := probe.Ready(); err != nil {
+			slog.Error("Failed to load dns probe",
+				slog.String("key", key),
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+
+		slog.Info("Add dns probe",
+			slog.String("key", key),
+			slog.Duration("interval", probe.DnsProbeOptions.Interval),
+			slog.String("server", probe.DnsProbeOptions.Server),
+			slog.String("name", probe.DnsProbeOptions.Name))
+
+		probes = append(probes, &probe)
+	}
+
+	if pushgatewayPruner != nil {
+
+		var activeProbes []string
+		for _, probe := range probes {
+			activeProbes = append(activeProbes, probe.ID())
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := pushgatewayPruner.DeleteStaleGroups(ctx, activeProbes); err != nil {
+			slog.Warn("Failed to delete stale pushgateway groups",
+				slog.String("err", err.Error()))
+		}
+		cancel()
+	}
+
 	ticker := time.NewTicker(time.Second)
 	exitCh := make(chan os.Signal, 2)
 	signal.Notify(exitCh, syscall.SIGINT, syscall.SIGTERM)
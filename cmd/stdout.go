@@ -31,18 +31,73 @@ func (this *StdoutWriter) WriteUptime(ctx context.Context, entry pulse.UptimeEnt
 		host = *entry.Host
 	}
 
+	ipFamily := "<nil>"
+	if entry.IpFamily != nil {
+		ipFamily = *entry.IpFamily
+	}
+
 	tlsVersion := "<nil>"
 	if entry.TlsVersion != nil {
 		tlsVersion = strconv.Itoa(*entry.TlsVersion)
 	}
 
+	errMessage := "<nil>"
+	if entry.Error != nil {
+		errMessage = *entry.Error
+	}
+
+	failureKind := "<nil>"
+	if entry.FailureKind != nil {
+		failureKind = string(*entry.FailureKind)
+	}
+
+	timings := slog.String("timings", "<nil>")
+	if entry.HttpTimings != nil {
+		timings = slog.Group("timings",
+			slog.Duration("dns", entry.HttpTimings.Dns),
+			slog.Duration("connect", entry.HttpTimings.Connect),
+			slog.Duration("tls", entry.HttpTimings.Tls),
+			slog.Duration("ttfb", entry.HttpTimings.Ttfb),
+			slog.Duration("transfer", entry.HttpTimings.Transfer))
+	}
+
+	tlsCert := slog.String("tls_cert", "<nil>")
+	if entry.TlsCert != nil {
+		tlsCert = slog.Group("tls_cert",
+			slog.String("subject", entry.TlsCert.Subject),
+			slog.String("issuer", entry.TlsCert.Issuer),
+			slog.Any("dns_names", entry.TlsCert.DnsNames),
+			slog.Time("not_after", entry.TlsCert.NotAfter),
+			slog.Int("days_left", entry.TlsCert.DaysLeft),
+			slog.Bool("valid", entry.TlsCert.Valid))
+	}
+
+	icmpStats := slog.String("icmp", "<nil>")
+	if entry.IcmpStats != nil {
+		icmpStats = slog.Group("icmp",
+			slog.Int("sent", entry.IcmpStats.Sent),
+			slog.Int("received", entry.IcmpStats.Received),
+			slog.Float64("loss", entry.IcmpStats.Loss),
+			slog.Duration("rtt_min", entry.IcmpStats.MinRtt),
+			slog.Duration("rtt_avg", entry.IcmpStats.AvgRtt),
+			slog.Duration("rtt_max", entry.IcmpStats.MaxRtt),
+			slog.Duration("rtt_stddev", entry.IcmpStats.StdDevRtt),
+			slog.Duration("jitter", entry.IcmpStats.Jitter))
+	}
+
 	slog.Info("STDOUT Uptime",
 		slog.String("label", entry.Label),
 		slog.Bool("ok", entry.Up),
 		slog.Duration("elapsed", entry.ProbeElapsed),
 		slog.String("host", host),
+		slog.String("ip_family", ipFamily),
 		slog.Any("latency", entry.Latency),
 		slog.String("http_status", status),
-		slog.String("tls_version", tlsVersion))
+		slog.String("tls_version", tlsVersion),
+		slog.String("error", errMessage),
+		slog.String("failure_kind", failureKind),
+		timings,
+		tlsCert,
+		icmpStats)
 	return nil
 }
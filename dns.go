@@ -0,0 +1,575 @@
+package pulse
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/yaml.v3"
+)
+
+// UDP payload size advertised with EDNS0
+const dnsUdpPayloadSize = 1232
+
+type DnsProbe struct {
+	DnsProbeOptions
+
+	Label  string
+	Writer StorageWriter
+
+	locked     atomic.Bool
+	nextExec   time.Time
+	question   *dnsmessage.Question
+	expectCode dnsmessage.RCode
+}
+
+type DnsProbeOptions struct {
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	Timeout  time.Duration `yaml:"timeout" json:"timeout"`
+	Server   string        `yaml:"server" json:"server"`
+	Protocol string        `yaml:"protocol" json:"protocol"`
+	Name     string        `yaml:"name" json:"name"`
+	Record   string        `yaml:"record" json:"record"`
+	Expect   DnsAnswerList `yaml:"expect" json:"expect"`
+	Rcode    string        `yaml:"rcode" json:"rcode"`
+	Retries  int           `yaml:"retries" json:"retries"`
+}
+
+// A list of expected dns answers. A single answer can be set as a plain string
+type DnsAnswerList []string
+
+func (this *DnsAnswerList) UnmarshalYAML(node *yaml.Node) error {
+
+	switch node.Kind {
+
+	case yaml.ScalarNode:
+		*this = DnsAnswerList{node.Value}
+		return nil
+
+	case yaml.SequenceNode:
+
+		var list []string
+		if err := node.Decode(&list); err != nil {
+			return err
+		}
+
+		*this = list
+		return nil
+
+	default:
+		return fmt.Errorf("line %d: answer list must be a scalar or a sequence", node.Line)
+	}
+}
+
+func (this *DnsAnswerList) UnmarshalJSON(data []byte) error {
+
+	var val string
+	if err := json.Unmarshal(data, &val); err == nil {
+		*this = DnsAnswerList{val}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	*this = list
+	return nil
+}
+
+func (this *DnsProbe) ID() string {
+	return this.Label
+}
+
+func (this *DnsProbe) Type() string {
+	return "dns"
+}
+
+func (this *DnsProbe) validateConfig() error {
+
+	switch {
+	case this.Label == "":
+		return errors.New("label is empty")
+	case this.Server == "":
+		return errors.New("empty server")
+	case this.Name == "":
+		return errors.New("empty name")
+	}
+
+	if _, _, err := net.SplitHostPort(this.Server); err != nil {
+		this.Server = net.JoinHostPort(strings.Trim(this.Server, "[]"), "53")
+	}
+
+	if this.Interval <= time.Second {
+		this.Interval = time.Minute
+	}
+
+	this.Protocol = strings.ToLower(this.Protocol)
+
+	switch this.Protocol {
+	case "udp", "tcp":
+		break
+	case "":
+		this.Protocol = "udp"
+	default:
+		return fmt.Errorf("unsupported protocol '%s'", this.Protocol)
+	}
+
+	if this.question == nil {
+
+		recordType, err := parseDnsRecordType(this.Record)
+		if err != nil {
+			return fmt.Errorf("record: %v", err)
+		}
+
+		name, err := dnsmessage.NewName(dnsFqdn(this.Name))
+		if err != nil {
+			return fmt.Errorf("name: %v", err)
+		}
+
+		this.question = &dnsmessage.Question{
+			Name:  name,
+			Type:  recordType,
+			Class: dnsmessage.ClassINET,
+		}
+	}
+
+	code, err := parseDnsRcode(this.Rcode)
+	if err != nil {
+		return fmt.Errorf("rcode: %v", err)
+	}
+
+	this.expectCode = code
+
+	return nil
+}
+
+func (this *DnsProbe) Ready() (bool, error) {
+
+	if err := this.validateConfig(); err != nil {
+		return false, err
+	}
+
+	if this.Writer == nil {
+		return false, errors.New("writer is nil")
+	}
+
+	//	check locks
+	if this.locked.Load() {
+		return false, nil
+	}
+
+	if this.nextExec.IsZero() || this.nextExec.Before(time.Now()) {
+		this.nextExec = time.Now().Add(this.Interval)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (this *DnsProbe) Exec(ctx context.Context) error {
+
+	if _, err := this.Ready(); err != nil {
+		return err
+	}
+
+	if !this.locked.CompareAndSwap(false, true) {
+		return errors.New("task locked")
+	}
+	defer this.locked.Store(false)
+
+	timeout := 10 * time.Second
+	if this.DnsProbeOptions.Timeout > 0 {
+		timeout = this.DnsProbeOptions.Timeout
+	}
+
+	type queryStatus struct {
+		ServerAddr net.IP
+		Latency    time.Duration
+		Rcode      dnsmessage.RCode
+		Answers    []string
+		Err        error
+	}
+
+	var fetchStatus = func(ctx context.Context) *queryStatus {
+
+		var status queryStatus
+
+		query, queryID, err := this.buildQuery()
+		if err != nil {
+			return &queryStatus{Err: err}
+		}
+
+		started := time.Now()
+
+		resp, serverAddr, err := dnsExchange(ctx, this.Protocol, this.Server, query)
+		status.ServerAddr = serverAddr
+
+		//	truncated udp responses are repeated over tcp, the same way stub resolvers do it
+		if err == nil && this.Protocol == "udp" && dnsIsTruncated(resp) {
+			resp, serverAddr, err = dnsExchange(ctx, "tcp", this.Server, query)
+			status.ServerAddr = serverAddr
+		}
+
+		if err != nil {
+			status.Err = err
+			return &status
+		}
+
+		status.Latency = time.Since(started)
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(resp); err != nil {
+			status.Err = fmt.Errorf("invalid response: %v", err)
+			return &status
+		}
+
+		if msg.Header.ID != queryID {
+			status.Err = errors.New("response id mismatch")
+			return &status
+		}
+
+		status.Rcode = msg.Header.RCode
+
+		for _, answer := range msg.Answers {
+			if answer.Header.Type == this.question.Type {
+				status.Answers = append(status.Answers, fmtDnsResource(answer.Body))
+			}
+		}
+
+		return &status
+	}
+
+	queryCtx, cancelQuery := context.WithTimeout(ctx, timeout)
+	defer cancelQuery()
+
+	started := time.Now()
+
+	status := fetchStatus(queryCtx)
+
+	if status.Err != nil && this.DnsProbeOptions.Retries > 0 {
+		for n := 0; n < this.DnsProbeOptions.Retries && queryCtx.Err() == nil; n++ {
+			if status = fetchStatus(queryCtx); status.Err == nil {
+				break
+			}
+		}
+	}
+
+	entry := UptimeEntry{
+		Label:        this.Label,
+		Timestamp:    time.Now(),
+		ProbeType:    this.Type(),
+		ProbeElapsed: time.Since(started),
+	}
+
+	if status.ServerAddr != nil {
+		host := status.ServerAddr.String()
+		entry.Host = &host
+	}
+
+	switch {
+
+	case status.Err != nil:
+		entry.setFailure(classifyError(status.Err), status.Err)
+
+	case status.Rcode != this.expectCode:
+		entry.setFailure(FailureBadStatus, fmt.Errorf("unexpected rcode: %s", fmtDnsRcode(status.Rcode)))
+
+	default:
+
+		if err := this.checkAnswers(status.Answers); err != nil {
+			entry.setFailure(FailureAssertion, err)
+			break
+		}
+
+		entry.Up = true
+		entry.Latency = &status.Latency
+	}
+
+	if err := this.Writer.WriteUptime(ctx, entry); err != nil {
+		return fmt.Errorf("storage.WriteUptime: %v", err)
+	}
+
+	return nil
+}
+
+func (this *DnsProbe) buildQuery() ([]byte, uint16, error) {
+
+	queryID := uint16(rand.Uint32())
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               queryID,
+		RecursionDesired: true,
+	})
+	builder.EnableCompression()
+
+	if err := builder.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	if err := builder.Question(*this.question); err != nil {
+		return nil, 0, err
+	}
+
+	if err := builder.StartAdditionals(); err != nil {
+		return nil, 0, err
+	}
+
+	var optHeader dnsmessage.ResourceHeader
+	if err := optHeader.SetEDNS0(dnsUdpPayloadSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, 0, err
+	}
+
+	if err := builder.OPTResource(optHeader, dnsmessage.OPTResource{}); err != nil {
+		return nil, 0, err
+	}
+
+	query, err := builder.Finish()
+	return query, queryID, err
+}
+
+// Checks that every expected value is present in the answers
+func (this *DnsProbe) checkAnswers(answers []string) error {
+
+	if len(this.Expect) > 0 && len(answers) == 0 {
+		return errors.New("no answers")
+	}
+
+	for _, expected := range this.Expect {
+
+		expected = normalizeDnsAnswer(this.question.Type, expected)
+
+		var found bool
+		for _, answer := range answers {
+			if normalizeDnsAnswer(this.question.Type, answer) == expected {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("expected answer '%s' not found in [%s]", expected, strings.Join(answers, ", "))
+		}
+	}
+
+	return nil
+}
+
+// Sends a query and reads the response. Returns the server address that was used
+func dnsExchange(ctx context.Context, network string, server string, query []byte) ([]byte, net.IP, error) {
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	var serverAddr net.IP
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		serverAddr = addr.IP
+	case *net.TCPAddr:
+		serverAddr = addr.IP
+	}
+
+	if deadline, has := ctx.Deadline(); has {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+
+		msg := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(msg, uint16(len(query)))
+		copy(msg[2:], query)
+
+		if _, err := conn.Write(msg); err != nil {
+			return nil, serverAddr, err
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, serverAddr, err
+		}
+
+		resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, serverAddr, err
+		}
+
+		return resp, serverAddr, nil
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, serverAddr, err
+	}
+
+	resp := make([]byte, dnsUdpPayloadSize)
+
+	//	anyone can send a packet to the port, so the replies that don't match the query are skipped until the deadline
+	for {
+
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, serverAddr, err
+		}
+
+		if dnsIsReply(query, resp[:n]) {
+			return resp[:n], serverAddr, nil
+		}
+	}
+}
+
+// Checks that the response has the same id and question as the query
+func dnsIsReply(query []byte, resp []byte) bool {
+
+	var queryParser dnsmessage.Parser
+	var respParser dnsmessage.Parser
+
+	queryHeader, err := queryParser.Start(query)
+	if err != nil {
+		return false
+	}
+
+	respHeader, err := respParser.Start(resp)
+	if err != nil || !respHeader.Response || respHeader.ID != queryHeader.ID {
+		return false
+	}
+
+	queryQuestion, err := queryParser.Question()
+	if err != nil {
+		return false
+	}
+
+	respQuestion, err := respParser.Question()
+	if err != nil {
+		return false
+	}
+
+	return respQuestion.Type == queryQuestion.Type &&
+		respQuestion.Class == queryQuestion.Class &&
+		strings.EqualFold(respQuestion.Name.String(), queryQuestion.Name.String())
+}
+
+func dnsIsTruncated(resp []byte) bool {
+
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(resp)
+	if err != nil {
+		return false
+	}
+
+	return header.Truncated
+}
+
+func parseDnsRecordType(val string) (dnsmessage.Type, error) {
+	switch strings.ToUpper(val) {
+	case "A", "":
+		return dnsmessage.TypeA, nil
+	case "AAAA":
+		return dnsmessage.TypeAAAA, nil
+	case "CNAME":
+		return dnsmessage.TypeCNAME, nil
+	case "MX":
+		return dnsmessage.TypeMX, nil
+	case "TXT":
+		return dnsmessage.TypeTXT, nil
+	case "SRV":
+		return dnsmessage.TypeSRV, nil
+	default:
+		return 0, fmt.Errorf("unsupported record type '%s'", val)
+	}
+}
+
+var dnsRcodeNames = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+func parseDnsRcode(val string) (dnsmessage.RCode, error) {
+
+	if val == "" {
+		return dnsmessage.RCodeSuccess, nil
+	}
+
+	for code, name := range dnsRcodeNames {
+		if strings.EqualFold(name, val) {
+			return code, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unsupported rcode '%s'", val)
+}
+
+func fmtDnsRcode(code dnsmessage.RCode) string {
+
+	if name, has := dnsRcodeNames[code]; has {
+		return name
+	}
+
+	return fmt.Sprintf("RCODE%d", code)
+}
+
+func fmtDnsResource(body dnsmessage.ResourceBody) string {
+	switch body := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(body.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(body.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return body.CNAME.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", body.Pref, body.MX.String())
+	case *dnsmessage.TXTResource:
+		return strings.Join(body.TXT, "")
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", body.Priority, body.Weight, body.Port, body.Target.String())
+	default:
+		return body.GoString()
+	}
+}
+
+// Makes answers comparable regardless of host name letter case, trailing dots and ip notation.
+// TXT records are case-sensitive and can contain anything, so they're compared as is
+func normalizeDnsAnswer(recordType dnsmessage.Type, val string) string {
+
+	if recordType == dnsmessage.TypeTXT {
+		return val
+	}
+
+	val = strings.TrimSpace(val)
+
+	if ip := net.ParseIP(val); ip != nil {
+		return ip.String()
+	}
+
+	fields := strings.Fields(val)
+	for idx, field := range fields {
+		fields[idx] = strings.TrimSuffix(field, ".")
+	}
+
+	return strings.ToLower(strings.Join(fields, " "))
+}
+
+func dnsFqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
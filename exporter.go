@@ -0,0 +1,386 @@
+package pulse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency histogram bucket bounds, in seconds
+var exporterLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Gauges that are set from the latest entry of every probe. The value func returns false when the entry doesn't have the value
+var exporterGauges = []exporterGauge{
+	{
+		Name: "pulse_up",
+		Help: "Whether the service was up during the last probe run",
+		Value: func(entry UptimeEntry) (float64, bool) {
+			return exporterBool(entry.Up), true
+		},
+	},
+	{
+		Name: "pulse_probe_duration_seconds",
+		Help: "Time the last probe run took",
+		Value: func(entry UptimeEntry) (float64, bool) {
+			return entry.ProbeElapsed.Seconds(), true
+		},
+	},
+	{
+		Name: "pulse_last_latency_seconds",
+		Help: "Service latency measured by the last probe run",
+		Value: func(entry UptimeEntry) (float64, bool) {
+			if entry.Latency == nil {
+				return 0, false
+			}
+			return entry.Latency.Seconds(), true
+		},
+	},
+	{
+		Name: "pulse_http_status",
+		Help: "HTTP status code returned during the last probe run",
+		Value: func(entry UptimeEntry) (float64, bool) {
+			if entry.HttpStatus == nil {
+				return 0, false
+			}
+			return float64(*entry.HttpStatus), true
+		},
+	},
+	{
+		Name: "pulse_tls_version",
+		Help: "TLS version used during the last probe run",
+		Value: func(entry UptimeEntry) (float64, bool) {
+			if entry.TlsVersion == nil {
+				return 0, false
+			}
+			return float64(*entry.TlsVersion), true
+		},
+	},
+	{
+		Name: "pulse_tls_cert_expiry_timestamp_seconds",
+		Help: "Server certificate expiration date as a unix timestamp",
+		Value: func(entry UptimeEntry) (float64, bool) {
+			if entry.TlsCert == nil {
+				return 0, false
+			}
+			return float64(entry.TlsCert.NotAfter.Unix()), true
+		},
+	},
+	{
+		Name: "pulse_tls_cert_valid",
+		Help: "Whether the server certificate chain is valid",
+		Value: func(entry UptimeEntry) (float64, bool) {
+			if entry.TlsCert == nil {
+				return 0, false
+			}
+			return exporterBool(entry.TlsCert.Valid), true
+		},
+	},
+	{
+		Name: "pulse_icmp_packet_loss_ratio",
+		Help: "ICMP packet loss during the last probe run",
+		Value: func(entry UptimeEntry) (float64, bool) {
+			if entry.IcmpStats == nil {
+				return 0, false
+			}
+			return entry.IcmpStats.Loss / 100, true
+		},
+	},
+	{
+		Name: "pulse_icmp_jitter_seconds",
+		Help: "ICMP round trip time jitter during the last probe run",
+		Value: func(entry UptimeEntry) (float64, bool) {
+			if entry.IcmpStats == nil || entry.IcmpStats.Received < 2 {
+				return 0, false
+			}
+			return entry.IcmpStats.Jitter.Seconds(), true
+		},
+	},
+}
+
+type exporterGauge struct {
+	Name  string
+	Help  string
+	Value func(entry UptimeEntry) (float64, bool)
+}
+
+func exporterBool(val bool) float64 {
+	if val {
+		return 1
+	}
+	return 0
+}
+
+// Starts an http server that serves the latest probe results on /metrics in prometheus text format
+func NewPrometheusExporter(listenAddr string) (*prometheusExporter, error) {
+
+	if listenAddr == "" {
+		return nil, errors.New("listen address is empty")
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &prometheusExporter{
+		series: map[string]*exporterSeries{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", this.handleMetrics)
+
+	this.srv = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := this.srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("EXPORTER: Server error",
+				slog.String("err", err.Error()))
+		}
+	}()
+
+	slog.Info("EXPORTER: Serving metrics",
+		slog.String("addr", listener.Addr().String()))
+
+	return this, nil
+}
+
+type prometheusExporter struct {
+	srv *http.Server
+
+	mtx sync.Mutex
+	//	series are never deleted: probes are only loaded on startup,
+	//	so the series of a probe that was removed from the config stay until pulse is restarted
+	series map[string]*exporterSeries
+}
+
+// Stores the latest entry and aggregated values of a single probe
+type exporterSeries struct {
+	Labels  map[string]string
+	Entry   UptimeEntry
+	Runs    uint64
+	Fails   map[FailureKind]uint64
+	Buckets []uint64
+	Sum     float64
+	Count   uint64
+}
+
+// Returns client TypeID
+func (this *prometheusExporter) Type() string {
+	return "exporter"
+}
+
+// Returns client version
+func (this *prometheusExporter) Version() string {
+	return "v1"
+}
+
+// Stops the http server
+func (this *prometheusExporter) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return this.srv.Shutdown(ctx)
+}
+
+// Updates probe metrics with a single uptime entry
+func (this *prometheusExporter) WriteUptime(ctx context.Context, entry UptimeEntry) error {
+
+	if entry.Label == "" {
+		return errors.New("empty entry label")
+	}
+
+	//	host addresses change over time and aren't a part of the series,
+	//	otherwise every dns change would leave a stale series behind
+	labels := map[string]string{
+		"probe":      entry.Label,
+		"probe_type": entry.ProbeType,
+	}
+
+	if entry.IpFamily != nil {
+		labels["ip_family"] = *entry.IpFamily
+	}
+
+	key := exporterLabelString(labels)
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	series := this.series[key]
+	if series == nil {
+		series = &exporterSeries{
+			Labels:  labels,
+			Fails:   map[FailureKind]uint64{},
+			Buckets: make([]uint64, len(exporterLatencyBuckets)),
+		}
+		this.series[key] = series
+	}
+
+	series.Runs++
+	series.observe(entry)
+
+	//	delayed entries (batches, replayed buffers) can't override newer results
+	if !entry.Timestamp.Before(series.Entry.Timestamp) {
+		series.Entry = entry
+	}
+
+	return nil
+}
+
+func (this *exporterSeries) observe(entry UptimeEntry) {
+
+	if entry.FailureKind != nil {
+		this.Fails[*entry.FailureKind]++
+	}
+
+	if entry.Latency == nil {
+		return
+	}
+
+	latency := entry.Latency.Seconds()
+
+	for idx, bound := range exporterLatencyBuckets {
+		if latency <= bound {
+			this.Buckets[idx]++
+		}
+	}
+
+	this.Sum += latency
+	this.Count++
+}
+
+func (this *prometheusExporter) handleMetrics(wrt http.ResponseWriter, req *http.Request) {
+	wrt.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	wrt.Write([]byte(this.render()))
+}
+
+func (this *prometheusExporter) render() string {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	var keys []string
+	for key := range this.series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var builder strings.Builder
+
+	var writeHeader = func(name, kind, help string) {
+		builder.WriteString(fmt.Sprintf("# HELP %s %s\n", name, help))
+		builder.WriteString(fmt.Sprintf("# TYPE %s %s\n", name, kind))
+	}
+
+	var writeSample = func(name string, labels map[string]string, val float64) {
+		builder.WriteString(fmt.Sprintf("%s{%s} %s\n", name, exporterLabelString(labels), strconv.FormatFloat(val, 'f', -1, 64)))
+	}
+
+	//	writes a gauge for every series that has a value for it
+	var writeGauge = func(name, help string, value func(entry UptimeEntry) (float64, bool)) {
+
+		var headerWritten bool
+
+		for _, key := range keys {
+
+			series := this.series[key]
+
+			val, has := value(series.Entry)
+			if !has {
+				continue
+			}
+
+			if !headerWritten {
+				writeHeader(name, "gauge", help)
+				headerWritten = true
+			}
+
+			writeSample(name, series.Labels, val)
+		}
+	}
+
+	for _, gauge := range exporterGauges {
+		writeGauge(gauge.Name, gauge.Help, gauge.Value)
+	}
+
+	if len(keys) > 0 {
+
+		writeHeader("pulse_probe_runs_total", "counter", "Number of probe runs")
+
+		for _, key := range keys {
+			series := this.series[key]
+			writeSample("pulse_probe_runs_total", series.Labels, float64(series.Runs))
+		}
+
+		writeHeader("pulse_probe_failures_total", "counter", "Number of failed probe runs by failure reason")
+
+		for _, key := range keys {
+
+			series := this.series[key]
+
+			var kinds []string
+			for kind := range series.Fails {
+				kinds = append(kinds, string(kind))
+			}
+
+			sort.Strings(kinds)
+
+			for _, kind := range kinds {
+				labels := exporterWithLabel(series.Labels, "failure_kind", kind)
+				writeSample("pulse_probe_failures_total", labels, float64(series.Fails[FailureKind(kind)]))
+			}
+		}
+
+		writeHeader("pulse_latency_seconds", "histogram", "Service latency distribution")
+
+		for _, key := range keys {
+
+			series := this.series[key]
+
+			for idx, bound := range exporterLatencyBuckets {
+				labels := exporterWithLabel(series.Labels, "le", strconv.FormatFloat(bound, 'f', -1, 64))
+				writeSample("pulse_latency_seconds_bucket", labels, float64(series.Buckets[idx]))
+			}
+
+			writeSample("pulse_latency_seconds_bucket", exporterWithLabel(series.Labels, "le", "+Inf"), float64(series.Count))
+			writeSample("pulse_latency_seconds_sum", series.Labels, series.Sum)
+			writeSample("pulse_latency_seconds_count", series.Labels, float64(series.Count))
+		}
+	}
+
+	return builder.String()
+}
+
+// Returns a copy of the labels with one more label added
+func exporterWithLabel(labels map[string]string, key, val string) map[string]string {
+
+	result := map[string]string{key: val}
+	for key, val := range labels {
+		result[key] = val
+	}
+
+	return result
+}
+
+// Formats labels as a sorted 'key="value"' list
+func exporterLabelString(labels map[string]string) string {
+
+	var pairs []string
+	for key, val := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", key, pushgatewayEscapeLabel(val)))
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,91 @@
+package pulse
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Classifies the reason why a probe has failed
+type FailureKind string
+
+const (
+	//	Host name could not be resolved
+	FailureDns FailureKind = "dns"
+	//	Connection was refused or reset by the remote
+	FailureRefused FailureKind = "refused"
+	//	Remote didn't respond in time
+	FailureTimeout FailureKind = "timeout"
+	//	TLS handshake has failed or the certificate is about to expire
+	FailureTls FailureKind = "tls"
+	//	Server certificate was rejected
+	FailureTlsVerify FailureKind = "tls_verify"
+	//	Unexpected http status code
+	FailureBadStatus FailureKind = "bad_status"
+	//	Response assertion didn't pass
+	FailureAssertion FailureKind = "assertion"
+	//	Proxy connection has failed
+	FailureProxy FailureKind = "proxy"
+	//	Too many echo requests were lost
+	FailurePacketLoss FailureKind = "packet_loss"
+	//	Anything else
+	FailureUnknown FailureKind = "unknown"
+)
+
+// Derives failure kind from a network or a request error
+func classifyError(err error) FailureKind {
+
+	if err == nil {
+		return FailureUnknown
+	}
+
+	//	proxy errors wrap the underlying network errors, so they go first
+	if isProxyError(err) {
+		return FailureProxy
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return FailureTimeout
+		}
+		return FailureDns
+	}
+
+	//	happens when the host has no addresses of the requested family
+	var addrErr *net.AddrError
+	if errors.As(err, &addrErr) {
+		return FailureDns
+	}
+
+	if isTlsVerifyError(err) {
+		return FailureTlsVerify
+	}
+
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) || isTlsAlertError(err) {
+		return FailureTls
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return FailureTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return FailureTimeout
+	}
+
+	var handshakeErr *tlsHandshakeError
+	if errors.As(err, &handshakeErr) {
+		return FailureTls
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return FailureRefused
+	}
+
+	return FailureUnknown
+}
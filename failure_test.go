@@ -0,0 +1,142 @@
+package pulse
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testCaptureWriter struct {
+	entries []UptimeEntry
+}
+
+func (this *testCaptureWriter) Type() string {
+	return "capture"
+}
+
+func (this *testCaptureWriter) Version() string {
+	return "v1"
+}
+
+func (this *testCaptureWriter) WriteUptime(ctx context.Context, entry UptimeEntry) error {
+	this.entries = append(this.entries, entry)
+	return nil
+}
+
+func testHttpProbeFailure(t *testing.T, opts HttpProbeOptions) *FailureKind {
+
+	writer := &testCaptureWriter{}
+
+	probe := HttpProbe{
+		Label:            "test",
+		Writer:           writer,
+		HttpProbeOptions: opts,
+	}
+
+	if err := probe.Exec(context.Background()); err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+
+	if len(writer.entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(writer.entries))
+	}
+
+	return writer.entries[0].FailureKind
+}
+
+func TestHttpFailureTlsVerify(t *testing.T) {
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	//	the test server certificate is self-signed
+	kind := testHttpProbeFailure(t, HttpProbeOptions{Url: srv.URL})
+	if kind == nil || *kind != FailureTlsVerify {
+		t.Fatalf("expected %q, got %v", FailureTlsVerify, kind)
+	}
+}
+
+func TestHttpFailureTlsRecord(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	//	a plain http server responds with something that isn't a tls record
+	kind := testHttpProbeFailure(t, HttpProbeOptions{Url: "https://" + srv.Listener.Addr().String()})
+	if kind == nil || *kind != FailureTls {
+		t.Fatalf("expected %q, got %v", FailureTls, kind)
+	}
+}
+
+func TestHttpFailureTlsAlert(t *testing.T) {
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+		MaxVersion: tls.VersionTLS12,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	verify := false
+
+	//	the server aborts the handshake with an alert because there's no client certificate
+	kind := testHttpProbeFailure(t, HttpProbeOptions{Url: srv.URL, Tls: &TlsOptions{Verify: &verify}})
+	if kind == nil || *kind != FailureTls {
+		t.Fatalf("expected %q, got %v", FailureTls, kind)
+	}
+}
+
+func TestHttpFailureTlsHandshake(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	//	the connection is accepted, but dropped without a server hello
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			buff := make([]byte, 1024)
+			conn.Read(buff)
+			conn.Close()
+		}
+	}()
+
+	kind := testHttpProbeFailure(t, HttpProbeOptions{Url: "https://" + listener.Addr().String()})
+	if kind == nil || *kind != FailureTls {
+		t.Fatalf("expected %q, got %v", FailureTls, kind)
+	}
+}
+
+func TestHttpFailureTlsCertExpiry(t *testing.T) {
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	//	the certificate is valid, but expires earlier than that
+	kind := testHttpProbeFailure(t, HttpProbeOptions{
+		Url:        srv.URL,
+		CertExpiry: 1_000_000,
+		Tls:        &TlsOptions{CaFile: caFile},
+	})
+	if kind == nil || *kind != FailureTls {
+		t.Fatalf("expected %q, got %v", FailureTls, kind)
+	}
+}
@@ -1,15 +1,21 @@
 package pulse
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -23,21 +29,69 @@ type HttpProbe struct {
 	Label  string
 	Writer StorageWriter
 
-	locked      atomic.Bool
-	nextExec    time.Time
-	proxyDialer proxy.ContextDialer
-	client      *http.Client
-	req         *http.Request
+	locked        atomic.Bool
+	nextExec      time.Time
+	proxyDialer   proxy.ContextDialer
+	clients       map[string]*http.Client
+	tlsConfig     *tls.Config
+	req           *http.Request
+	statusMatcher *httpStatusMatcher
 }
 
 type HttpProbeOptions struct {
-	Interval time.Duration     `yaml:"interval" json:"interval"`
-	Timeout  time.Duration     `yaml:"timeout" json:"timeout"`
-	Url      string            `yaml:"url" json:"url"`
-	Method   string            `yaml:"method" json:"method"`
-	Headers  map[string]string `yaml:"headers" json:"headers"`
-	ProxyUrl string            `yaml:"proxy_url" json:"proxy_url"`
-	Retries  int               `yaml:"retries" json:"retries"`
+	Interval     time.Duration     `yaml:"interval" json:"interval"`
+	Timeout      time.Duration     `yaml:"timeout" json:"timeout"`
+	Url          string            `yaml:"url" json:"url"`
+	Method       string            `yaml:"method" json:"method"`
+	Headers      map[string]string `yaml:"headers" json:"headers"`
+	ProxyUrl     string            `yaml:"proxy_url" json:"proxy_url"`
+	Retries      int               `yaml:"retries" json:"retries"`
+	Assert       *HttpAssertions   `yaml:"assert" json:"assert"`
+	ExpectStatus HttpStatusList    `yaml:"expect_status" json:"expect_status"`
+	CertExpiry   int               `yaml:"cert_expiry" json:"cert_expiry"`
+	Tls          *TlsOptions       `yaml:"tls" json:"tls"`
+	Body         string            `yaml:"body" json:"body"`
+	BodyFile     string            `yaml:"body_file" json:"body_file"`
+	Json         any               `yaml:"json" json:"json"`
+	IpFamily     string            `yaml:"ip_family" json:"ip_family"`
+}
+
+// Returns request body and its default content type
+func (this *HttpProbeOptions) requestBody() ([]byte, string, error) {
+
+	switch {
+
+	case this.Json != nil:
+		data, err := json.Marshal(this.Json)
+		if err != nil {
+			return nil, "", fmt.Errorf("json: %v", err)
+		}
+		return data, "application/json", nil
+
+	case this.BodyFile != "":
+
+		data, err := os.ReadFile(this.BodyFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("body_file: %v", err)
+		}
+
+		contentType := mime.TypeByExtension(filepath.Ext(this.BodyFile))
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+
+		return data, contentType, nil
+
+	case this.Body != "":
+		return []byte(this.Body), "text/plain; charset=utf-8", nil
+
+	default:
+		return nil, "", nil
+	}
+}
+
+func (this *HttpProbeOptions) hasBody() bool {
+	return this.Body != "" || this.BodyFile != "" || this.Json != nil
 }
 
 func (this *HttpProbe) ID() string {
@@ -65,8 +119,23 @@ func (this *HttpProbe) validateConfig() error {
 		this.Interval = time.Minute
 	}
 
+	var bodyOptions int
+	for _, isSet := range []bool{this.Body != "", this.BodyFile != "", this.Json != nil} {
+		if isSet {
+			bodyOptions++
+		}
+	}
+
+	if bodyOptions > 1 {
+		return errors.New("only one of body, body_file or json can be set")
+	}
+
 	this.Method = strings.ToUpper(this.Method)
 
+	if this.Method == "" && this.hasBody() {
+		this.Method = http.MethodPost
+	}
+
 	switch this.Method {
 	case http.MethodGet, http.MethodOptions, http.MethodHead, http.MethodPost:
 		break
@@ -78,6 +147,31 @@ func (this *HttpProbe) validateConfig() error {
 		this.Method = http.MethodGet
 	}
 
+	family, err := validateIpFamily(this.IpFamily)
+	if err != nil {
+		return err
+	}
+
+	this.IpFamily = family
+
+	if this.hasBody() && (this.Method == http.MethodGet || this.Method == http.MethodHead) {
+		return fmt.Errorf("http method '%s' can't have a request body", this.Method)
+	}
+
+	if this.statusMatcher == nil {
+		matcher, err := parseHttpStatusMatcher(this.ExpectStatus)
+		if err != nil {
+			return fmt.Errorf("expect_status: %v", err)
+		}
+		this.statusMatcher = matcher
+	}
+
+	if this.Assert != nil {
+		if err := this.Assert.validateConfig(); err != nil {
+			return fmt.Errorf("assert: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -91,6 +185,17 @@ func (this *HttpProbe) Ready() (bool, error) {
 		return false, errors.New("writer is nil")
 	}
 
+	//	initialize tls config
+	if this.tlsConfig == nil {
+
+		config, err := this.HttpProbeOptions.Tls.Config()
+		if err != nil {
+			return false, fmt.Errorf("tls: %v", err)
+		}
+
+		this.tlsConfig = config
+	}
+
 	//	initialize proxy state if provided
 	if this.HttpProbeOptions.ProxyUrl != "" && this.proxyDialer == nil {
 
@@ -99,18 +204,37 @@ func (this *HttpProbe) Ready() (bool, error) {
 			return false, fmt.Errorf("proxy_url: %v", err)
 		}
 
-		this.client = &http.Client{Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			DialContext:     dialer.DialContext,
-		}}
+		//	the proxy picks the address family by itself, so a probe restricted to a family would measure the wrong path
+		if this.IpFamily != IpFamilyAny && isRemoteDnsProxy(dialer) {
+			return false, fmt.Errorf("proxy_url: ip_family '%s' can't be used with proxies that resolve host names remotely", this.IpFamily)
+		}
+
 		this.proxyDialer = dialer
 	}
 
-	//	 initialize client
-	if this.client == nil {
-		this.client = &http.Client{Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}}
+	//	 initialize clients, one per address family
+	//	keep-alives are disabled to make every run go through dns, connect and tls phases
+	if this.clients == nil {
+
+		this.clients = map[string]*http.Client{}
+
+		var dialer proxy.ContextDialer = &net.Dialer{}
+		if this.proxyDialer != nil {
+			dialer = this.proxyDialer
+		}
+
+		for _, family := range expandIpFamily(this.IpFamily) {
+
+			transport := &http.Transport{
+				TLSClientConfig:   this.tlsConfig,
+				DisableKeepAlives: true,
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dialer.DialContext(ctx, ipFamilyNetwork(network, family), addr)
+				},
+			}
+
+			this.clients[family] = &http.Client{Transport: transport}
+		}
 	}
 
 	//	init request
@@ -134,13 +258,23 @@ func (this *HttpProbe) Ready() (bool, error) {
 			slog.String("remote", reqUrl.String()),
 			slog.String("label", this.Label))
 
-		req, err := http.NewRequest(method, reqUrl.String(), nil)
+		body, contentType, err := this.HttpProbeOptions.requestBody()
+		if err != nil {
+			return false, err
+		}
+
+		//	using a bytes reader lets NewRequest set GetBody, so that the body can be replayed by every request clone
+		req, err := http.NewRequest(method, reqUrl.String(), bytes.NewReader(body))
 		if err != nil {
 			return false, fmt.Errorf("http.NewRequest: %v", err)
 		}
 
 		req.Header.Set("User-Agent", "maddsua/pulse")
 
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
 		if this.HttpProbeOptions.Headers != nil {
 			for key, val := range this.HttpProbeOptions.Headers {
 				if strings.ToLower(key) == "host" {
@@ -177,49 +311,104 @@ func (this *HttpProbe) Exec(ctx context.Context) error {
 	}
 	defer this.locked.Store(false)
 
+	return execIpFamilies(this.IpFamily, func(family string) error {
+		return this.execFamily(ctx, family)
+	})
+}
+
+func (this *HttpProbe) execFamily(ctx context.Context, family string) error {
+
+	client := this.clients[family]
+
 	type responseStatus struct {
 		Elapsed    time.Duration
 		Status     *int
 		TlsVersion *int
+		Timings    *HttpTimings
+		TlsCert    *TlsCertInfo
+		RemoteHost *string
 		Err        error
+		AssertErr  error
+		CertErr    error
 	}
 
-	var fetchStatus = func(ctx context.Context) (*responseStatus, error) {
+	var fetchStatus = func(ctx context.Context) *responseStatus {
+
+		timer := httpTraceTimer{proxied: this.proxyDialer != nil}
+		ctx = httptrace.WithClientTrace(ctx, timer.ClientTrace())
+
+		req := this.req.Clone(ctx)
+
+		if req.GetBody != nil {
+
+			body, err := req.GetBody()
+			if err != nil {
+				return &responseStatus{Err: err}
+			}
+
+			req.Body = body
+		}
 
 		started := time.Now()
 
-		resp, err := this.client.Do(this.req.Clone(ctx))
+		resp, err := client.Do(req)
 		if err != nil {
 
-			if isProxyError(err) {
-				return nil, err
+			//	handshake errors mostly come from crypto/tls as plain strings, so the trace is the only way to tell them apart
+			if timer.TlsError() != nil {
+				err = &tlsHandshakeError{Err: err}
 			}
 
 			return &responseStatus{
-				Elapsed: time.Since(started),
-				Err:     err,
-			}, nil
+				Elapsed:    time.Since(started),
+				RemoteHost: timer.RemoteHost(),
+				Err:        err,
+			}
 		}
 
-		resp.Body.Close()
+		defer resp.Body.Close()
+
+		status := responseStatus{
+			Elapsed:    time.Since(started),
+			Status:     &resp.StatusCode,
+			RemoteHost: timer.RemoteHost(),
+		}
 
 		if resp.TLS != nil {
 			version := extractTlsVersion(resp.TLS.Version)
-			return &responseStatus{
-				Elapsed:    time.Since(started),
-				Status:     &resp.StatusCode,
-				TlsVersion: &version,
-			}, nil
+			status.TlsVersion = &version
+			status.TlsCert = inspectTlsCert(resp.TLS, this.tlsConfig.RootCAs)
 		}
 
-		return &responseStatus{
-			Elapsed: time.Since(started),
-			Status:  &resp.StatusCode,
-		}, nil
-	}
+		//	the body is only kept when the assertions need it, otherwise a small part of it is read
+		//	to get the transfer time without downloading large responses on every run
+		var body []byte
+		var readErr error
+
+		if this.Assert != nil && this.Assert.NeedsBody() {
+			body, readErr = io.ReadAll(io.LimitReader(resp.Body, this.Assert.MaxBodySize))
+		} else {
+			_, readErr = io.Copy(io.Discard, io.LimitReader(resp.Body, httpDiscardBodySize))
+		}
+
+		timer.BodyDone()
 
-	var isOkStatus = func(val int) bool {
-		return val >= http.StatusOK && val <= http.StatusIMUsed
+		timings := timer.Timings()
+		status.Timings = &timings
+
+		if this.Assert != nil {
+			status.AssertErr = this.checkAssertions(resp, body, readErr)
+		}
+
+		if status.TlsCert != nil && this.CertExpiry > 0 && status.TlsCert.DaysLeft < this.CertExpiry {
+			if status.TlsCert.DaysLeft < 0 {
+				status.CertErr = fmt.Errorf("tls certificate expired %d days ago", -status.TlsCert.DaysLeft)
+			} else {
+				status.CertErr = fmt.Errorf("tls certificate expires in %d days", status.TlsCert.DaysLeft)
+			}
+		}
+
+		return &status
 	}
 
 	timeout := 10 * time.Second
@@ -232,16 +421,11 @@ func (this *HttpProbe) Exec(ctx context.Context) error {
 
 	started := time.Now()
 
-	status, err := fetchStatus(requestCtx)
-	if err != nil {
-		return err
-	}
+	status := fetchStatus(requestCtx)
 
 	if status.Err != nil && this.HttpProbeOptions.Retries > 0 {
 		for n := 0; n < this.HttpProbeOptions.Retries && requestCtx.Err() == nil; n++ {
-			if status, err = fetchStatus(requestCtx); err != nil {
-				return err
-			} else if status.Err == nil {
+			if status = fetchStatus(requestCtx); status.Err == nil {
 				break
 			}
 		}
@@ -254,14 +438,27 @@ func (this *HttpProbe) Exec(ctx context.Context) error {
 		ProbeElapsed: time.Since(started),
 		TlsVersion:   status.TlsVersion,
 		HttpStatus:   status.Status,
+		HttpTimings:  status.Timings,
+		TlsCert:      status.TlsCert,
+		IpFamily:     ipFamilyTag(family),
+		Host:         status.RemoteHost,
 	}
 
-	if addr, err := net.ResolveIPAddr("ip", this.req.Host); err == nil {
-		host := addr.IP.String()
-		entry.Host = &host
-	}
+	switch {
+
+	case status.Err != nil:
+		entry.setFailure(classifyError(status.Err), status.Err)
+
+	case !this.statusMatcher.Match(*status.Status):
+		entry.setFailure(FailureBadStatus, fmt.Errorf("unexpected status code: %d", *status.Status))
+
+	case status.AssertErr != nil:
+		entry.setFailure(FailureAssertion, status.AssertErr)
+
+	case status.CertErr != nil:
+		entry.setFailure(FailureTls, status.CertErr)
 
-	if status.Status != nil && isOkStatus(*status.Status) {
+	default:
 		entry.Up = true
 		entry.Latency = &status.Elapsed
 	}
@@ -273,65 +470,19 @@ func (this *HttpProbe) Exec(ctx context.Context) error {
 	return nil
 }
 
-func getProxyUrlDialer(urlString string) (proxy.ContextDialer, error) {
-
-	if strings.HasPrefix(urlString, "$") {
-		urlString = os.Getenv(strings.ToUpper(urlString[1:]))
-	}
+func (this *HttpProbe) checkAssertions(resp *http.Response, body []byte, readErr error) error {
 
-	if urlString == "" {
-		return nil, errors.New("empty proxy url")
-	}
-
-	proxyUrl, err := url.Parse(urlString)
-	if err != nil {
-		return nil, fmt.Errorf("url.Parse: %v", err)
+	if err := this.Assert.CheckHeaders(resp.Header); err != nil {
+		return err
 	}
 
-	switch strings.ToLower(proxyUrl.Scheme) {
-
-	case "socks", "socks5":
-
-		var proxyAuth *proxy.Auth
-		if username := proxyUrl.User.Username(); username != "" {
-			pass, _ := proxyUrl.User.Password()
-			proxyAuth = &proxy.Auth{User: username, Password: pass}
-		}
-
-		dialer, err := proxy.SOCKS5("tcp", proxyUrl.Host, proxyAuth, proxy.Direct)
-		if err != nil {
-			return nil, err
-		}
-
-		return dialer.(proxy.ContextDialer), nil
-
-	default:
-		return nil, fmt.Errorf("unsupported proxy protocol: %v", proxyUrl.Scheme)
+	if !this.Assert.NeedsBody() {
+		return nil
 	}
-}
 
-func isProxyError(err error) bool {
-
-	if err == nil {
-		return false
+	if readErr != nil {
+		return fmt.Errorf("failed to read body: %v", readErr)
 	}
 
-	return strings.Contains(err.Error(), "socks connect tcp")
-}
-
-func extractTlsVersion(version uint16) int {
-	switch version {
-	case tls.VersionSSL30:
-		return 300
-	case tls.VersionTLS10:
-		return 100
-	case tls.VersionTLS11:
-		return 110
-	case tls.VersionTLS12:
-		return 120
-	case tls.VersionTLS13:
-		return 130
-	default:
-		return int(version)
-	}
+	return this.Assert.CheckBody(body)
 }
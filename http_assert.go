@@ -0,0 +1,263 @@
+package pulse
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Default limit of how much of the response body is read for the assertions
+const defaultHttpMaxBodySize = 1024 * 1024
+
+// Limit of how much of the response body is read when there are no body assertions
+const httpDiscardBodySize = 64 * 1024
+
+type HttpAssertions struct {
+	//	Response body must contain this substring
+	BodyContains string `yaml:"body_contains" json:"body_contains"`
+	//	Response body must match this regular expression
+	BodyRegex string `yaml:"body_regex" json:"body_regex"`
+	//	JSONPath expressions mapped to the values that they must be equal to
+	Json map[string]any `yaml:"json" json:"json"`
+	//	Headers that must be present in the response. Empty value only checks the presence of a header
+	Headers map[string]string `yaml:"headers" json:"headers"`
+	//	Headers that must not be present in the response
+	ForbidHeaders []string `yaml:"forbid_headers" json:"forbid_headers"`
+	//	Max number of body bytes to read (defaults to 1MB)
+	MaxBodySize int64 `yaml:"max_body_size" json:"max_body_size"`
+
+	bodyRegex *regexp.Regexp
+	jsonPaths map[string][]jsonPathStep
+}
+
+func (this *HttpAssertions) validateConfig() error {
+
+	if this.MaxBodySize <= 0 {
+		this.MaxBodySize = defaultHttpMaxBodySize
+	}
+
+	if this.BodyRegex != "" && this.bodyRegex == nil {
+		expr, err := regexp.Compile(this.BodyRegex)
+		if err != nil {
+			return fmt.Errorf("body_regex: %v", err)
+		}
+		this.bodyRegex = expr
+	}
+
+	if len(this.Json) > 0 && this.jsonPaths == nil {
+
+		paths := map[string][]jsonPathStep{}
+
+		for expr := range this.Json {
+			steps, err := parseJsonPath(expr)
+			if err != nil {
+				return fmt.Errorf("json: path '%s': %v", expr, err)
+			}
+			paths[expr] = steps
+		}
+
+		this.jsonPaths = paths
+	}
+
+	return nil
+}
+
+// Returns true if the response body has to be read to run the checks
+func (this *HttpAssertions) NeedsBody() bool {
+	return this.BodyContains != "" || this.BodyRegex != "" || len(this.Json) > 0
+}
+
+// Checks response headers. Returns an error describing the first failed assertion
+func (this *HttpAssertions) CheckHeaders(header http.Header) error {
+
+	for key, val := range this.Headers {
+
+		values, has := header[http.CanonicalHeaderKey(key)]
+		if !has {
+			return fmt.Errorf("header '%s' is missing", key)
+		}
+
+		if val != "" && !containsString(values, val) {
+			return fmt.Errorf("header '%s' doesn't match '%s'", key, val)
+		}
+	}
+
+	for _, key := range this.ForbidHeaders {
+		if _, has := header[http.CanonicalHeaderKey(key)]; has {
+			return fmt.Errorf("header '%s' is forbidden", key)
+		}
+	}
+
+	return nil
+}
+
+// Checks response body. Returns an error describing the first failed assertion
+func (this *HttpAssertions) CheckBody(body []byte) error {
+
+	if this.BodyContains != "" && !bytes.Contains(body, []byte(this.BodyContains)) {
+		return fmt.Errorf("body doesn't contain '%s'", this.BodyContains)
+	}
+
+	if this.bodyRegex != nil && !this.bodyRegex.Match(body) {
+		return fmt.Errorf("body doesn't match '%s'", this.BodyRegex)
+	}
+
+	if len(this.jsonPaths) > 0 {
+
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("body is not a valid json: %v", err)
+		}
+
+		for expr, steps := range this.jsonPaths {
+
+			val, has := evalJsonPath(doc, steps)
+			if !has {
+				return fmt.Errorf("json path '%s' not found", expr)
+			}
+
+			expected, err := normalizeJsonValue(this.Json[expr])
+			if err != nil {
+				return fmt.Errorf("json path '%s': %v", expr, err)
+			}
+
+			if !reflect.DeepEqual(val, expected) {
+				return fmt.Errorf("json path '%s' is %s, expected %s", expr, fmtJsonValue(val), fmtJsonValue(expected))
+			}
+		}
+	}
+
+	return nil
+}
+
+func containsString(values []string, val string) bool {
+	for _, item := range values {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+type jsonPathStep struct {
+	Key   string
+	Index int
+	IsIdx bool
+}
+
+// Parses a minimal subset of JSONPath: $.key.nested[0]["quoted key"]
+func parseJsonPath(expr string) ([]jsonPathStep, error) {
+
+	expr = strings.TrimSpace(expr)
+	expr = strings.TrimPrefix(expr, "$")
+
+	var steps []jsonPathStep
+
+	for len(expr) > 0 {
+
+		switch expr[0] {
+
+		case '.':
+
+			expr = expr[1:]
+
+			end := strings.IndexAny(expr, ".[")
+			if end == -1 {
+				end = len(expr)
+			}
+
+			if end == 0 {
+				return nil, errors.New("empty key")
+			}
+
+			steps = append(steps, jsonPathStep{Key: expr[:end]})
+			expr = expr[end:]
+
+		case '[':
+
+			end := strings.IndexByte(expr, ']')
+			if end == -1 {
+				return nil, errors.New("unterminated bracket")
+			}
+
+			token := expr[1:end]
+			expr = expr[end+1:]
+
+			if len(token) >= 2 && (token[0] == '"' || token[0] == '\'') && token[len(token)-1] == token[0] {
+				steps = append(steps, jsonPathStep{Key: token[1 : len(token)-1]})
+				continue
+			}
+
+			idx, err := strconv.Atoi(token)
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("invalid index '%s'", token)
+			}
+
+			steps = append(steps, jsonPathStep{Index: idx, IsIdx: true})
+
+		default:
+
+			//	allow omitting the leading dot: "status.code"
+			if len(steps) == 0 {
+				expr = "." + expr
+				continue
+			}
+
+			return nil, fmt.Errorf("unexpected character '%c'", expr[0])
+		}
+	}
+
+	return steps, nil
+}
+
+func evalJsonPath(doc any, steps []jsonPathStep) (any, bool) {
+
+	for _, step := range steps {
+
+		if step.IsIdx {
+
+			arr, ok := doc.([]any)
+			if !ok || step.Index >= len(arr) {
+				return nil, false
+			}
+
+			doc = arr[step.Index]
+			continue
+		}
+
+		obj, ok := doc.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+
+		if doc, ok = obj[step.Key]; !ok {
+			return nil, false
+		}
+	}
+
+	return doc, true
+}
+
+// Converts config values (that can come from yaml) to the same types that encoding/json produces
+func normalizeJsonValue(val any) (any, error) {
+
+	data, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+
+	var result any
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+func fmtJsonValue(val any) string {
+	data, _ := json.Marshal(val)
+	return string(data)
+}
@@ -0,0 +1,188 @@
+package pulse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A list of expected http status codes, ranges and negations: [200-299, 301, 401, !204]
+type HttpStatusList []string
+
+func (this *HttpStatusList) UnmarshalYAML(node *yaml.Node) error {
+
+	switch node.Kind {
+
+	case yaml.ScalarNode:
+		*this = splitStatusList(node.Value)
+		return nil
+
+	case yaml.SequenceNode:
+
+		var list HttpStatusList
+
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: status list items must be scalars", item.Line)
+			}
+			list = append(list, splitStatusList(item.Value)...)
+		}
+
+		*this = list
+		return nil
+
+	default:
+		return fmt.Errorf("line %d: status list must be a scalar or a sequence", node.Line)
+	}
+}
+
+func (this *HttpStatusList) UnmarshalJSON(data []byte) error {
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		items = []json.RawMessage{data}
+	}
+
+	var list HttpStatusList
+
+	for _, item := range items {
+
+		var val any
+		if err := json.Unmarshal(item, &val); err != nil {
+			return err
+		}
+
+		switch val := val.(type) {
+		case string:
+			list = append(list, splitStatusList(val)...)
+		case float64:
+			list = append(list, strconv.Itoa(int(val)))
+		default:
+			return fmt.Errorf("invalid status list item: %s", string(item))
+		}
+	}
+
+	*this = list
+	return nil
+}
+
+func splitStatusList(val string) []string {
+
+	var list []string
+
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+type httpStatusRange struct {
+	Min int
+	Max int
+}
+
+func (this httpStatusRange) Match(status int) bool {
+	return status >= this.Min && status <= this.Max
+}
+
+type httpStatusMatcher struct {
+	allow []httpStatusRange
+	deny  []httpStatusRange
+}
+
+func parseHttpStatusMatcher(list HttpStatusList) (*httpStatusMatcher, error) {
+
+	var matcher httpStatusMatcher
+
+	for _, item := range list {
+
+		negate := strings.HasPrefix(item, "!")
+		expr := strings.TrimSpace(strings.TrimPrefix(item, "!"))
+
+		rng, err := parseHttpStatusRange(expr)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %v", item, err)
+		}
+
+		if negate {
+			matcher.deny = append(matcher.deny, rng)
+		} else {
+			matcher.allow = append(matcher.allow, rng)
+		}
+	}
+
+	//	a list of only negations is applied on top of the default 2xx range
+	if len(matcher.allow) == 0 {
+		matcher.allow = append(matcher.allow, httpStatusRange{Min: http.StatusOK, Max: http.StatusIMUsed})
+	}
+
+	return &matcher, nil
+}
+
+func parseHttpStatusRange(expr string) (httpStatusRange, error) {
+
+	var parseCode = func(val string) (int, error) {
+
+		code, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil {
+			return 0, errors.New("not a number")
+		}
+
+		if code < 100 || code > 599 {
+			return 0, fmt.Errorf("status code %d out of range", code)
+		}
+
+		return code, nil
+	}
+
+	if minExpr, maxExpr, isRange := strings.Cut(expr, "-"); isRange {
+
+		minCode, err := parseCode(minExpr)
+		if err != nil {
+			return httpStatusRange{}, err
+		}
+
+		maxCode, err := parseCode(maxExpr)
+		if err != nil {
+			return httpStatusRange{}, err
+		}
+
+		if minCode > maxCode {
+			return httpStatusRange{}, errors.New("range start is greater than its end")
+		}
+
+		return httpStatusRange{Min: minCode, Max: maxCode}, nil
+	}
+
+	code, err := parseCode(expr)
+	if err != nil {
+		return httpStatusRange{}, err
+	}
+
+	return httpStatusRange{Min: code, Max: code}, nil
+}
+
+func (this *httpStatusMatcher) Match(status int) bool {
+
+	for _, rng := range this.deny {
+		if rng.Match(status) {
+			return false
+		}
+	}
+
+	for _, rng := range this.allow {
+		if rng.Match(status) {
+			return true
+		}
+	}
+
+	return false
+}
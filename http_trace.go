@@ -0,0 +1,147 @@
+package pulse
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Collects request phase timestamps and the remote address using net/http/httptrace hooks
+type httpTraceTimer struct {
+	mtx sync.Mutex
+
+	//	connections are dialed to the proxy then, so only the tunneled ones have the target address
+	proxied bool
+
+	remoteAddr string
+	tlsErr     error
+
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	bodyDone     time.Time
+}
+
+func (this *httpTraceTimer) set(field *time.Time) {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	//	only the first occurrence counts; this matters when the dialer races multiple addresses
+	if field.IsZero() {
+		*field = time.Now()
+	}
+}
+
+func (this *httpTraceTimer) ClientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			this.set(&this.dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			this.set(&this.dnsDone)
+		},
+		ConnectStart: func(string, string) {
+			this.set(&this.connectStart)
+		},
+		ConnectDone: func(network string, addr string, err error) {
+			this.set(&this.connectDone)
+			this.setRemoteAddr(addr, false)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			this.setRemoteAddr(info.Conn.RemoteAddr().String(), true)
+		},
+		TLSHandshakeStart: func() {
+			this.set(&this.tlsStart)
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			this.set(&this.tlsDone)
+			this.setTlsError(err)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			this.set(&this.wroteRequest)
+		},
+		GotFirstResponseByte: func() {
+			this.set(&this.firstByte)
+		},
+	}
+}
+
+// Stores the dialed address. The address of the connection that was actually used overrides the dialed ones,
+// which otherwise can be any of the addresses that the dialer has tried
+func (this *httpTraceTimer) setRemoteAddr(addr string, override bool) {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	if override || (this.remoteAddr == "" && !this.proxied) {
+		this.remoteAddr = addr
+	}
+}
+
+func (this *httpTraceTimer) setTlsError(err error) {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	if err != nil {
+		this.tlsErr = err
+	}
+}
+
+// Returns the error that the tls handshake has failed with, if any
+func (this *httpTraceTimer) TlsError() error {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	return this.tlsErr
+}
+
+// Returns the ip address of the remote host, or nil if no connection was attempted
+// or the address was resolved by a proxy
+func (this *httpTraceTimer) RemoteHost() *string {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	host, _, err := net.SplitHostPort(this.remoteAddr)
+	if err != nil || net.ParseIP(host) == nil {
+		return nil
+	}
+
+	return &host
+}
+
+// Marks the moment when the response body was fully read
+func (this *httpTraceTimer) BodyDone() {
+	this.set(&this.bodyDone)
+}
+
+func (this *httpTraceTimer) Timings() HttpTimings {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	var span = func(started, done time.Time) time.Duration {
+		if started.IsZero() || done.IsZero() || done.Before(started) {
+			return 0
+		}
+		return done.Sub(started)
+	}
+
+	return HttpTimings{
+		Dns:      span(this.dnsStart, this.dnsDone),
+		Connect:  span(this.connectStart, this.connectDone),
+		Tls:      span(this.tlsStart, this.tlsDone),
+		Ttfb:     span(this.wroteRequest, this.firstByte),
+		Transfer: span(this.firstByte, this.bodyDone),
+	}
+}
@@ -5,10 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync/atomic"
 	"time"
-
-	"github.com/tatsushid/go-fastping"
 )
 
 type IcmpProbe struct {
@@ -26,6 +25,15 @@ type IcmpProbeOptions struct {
 	Timeout  time.Duration `yaml:"timeout" json:"timeout"`
 	Host     string        `yaml:"host" json:"host"`
 	Retries  int           `yaml:"retries" json:"retries"`
+	Mode     string        `yaml:"mode" json:"mode"`
+	//	Number of echo requests to send per run
+	Count int `yaml:"count" json:"count"`
+	//	Interval between sending echo requests
+	PacketInterval time.Duration `yaml:"packet_interval" json:"packet_interval"`
+	//	Max packet loss percentage before the host is considered down
+	MaxLoss float64 `yaml:"max_loss" json:"max_loss"`
+	//	Address family to use: ip4, ip6, any or both
+	IpFamily string `yaml:"ip_family" json:"ip_family"`
 }
 
 func (this *IcmpProbe) ID() string {
@@ -49,6 +57,32 @@ func (this *IcmpProbe) validateConfig() error {
 		this.Interval = time.Minute
 	}
 
+	if this.Count <= 0 {
+		this.Count = 1
+	}
+
+	if this.PacketInterval <= 0 {
+		this.PacketInterval = time.Second
+	}
+
+	if this.MaxLoss < 0 || this.MaxLoss >= 100 {
+		return errors.New("max_loss must be in the range of [0, 100)")
+	}
+
+	mode, err := validateIcmpMode(this.Mode)
+	if err != nil {
+		return err
+	}
+
+	this.Mode = mode
+
+	family, err := validateIpFamily(this.IpFamily)
+	if err != nil {
+		return err
+	}
+
+	this.IpFamily = family
+
 	return nil
 }
 
@@ -86,6 +120,13 @@ func (this *IcmpProbe) Exec(ctx context.Context) error {
 	}
 	defer this.locked.Store(false)
 
+	return execIpFamilies(this.IpFamily, func(family string) error {
+		return this.execFamily(ctx, family)
+	})
+}
+
+func (this *IcmpProbe) execFamily(ctx context.Context, family string) error {
+
 	timeout := 10 * time.Second
 	if this.IcmpProbeOptions.Timeout > 0 {
 		timeout = this.IcmpProbeOptions.Timeout
@@ -93,47 +134,59 @@ func (this *IcmpProbe) Exec(ctx context.Context) error {
 
 	type pingStatus struct {
 		ResolvedAddr net.IP
-		Online       bool
-		Latency      time.Duration
+		Stats        IcmpStats
+		Err          error
 	}
 
 	var fetchStatus = func(ctx context.Context) (*pingStatus, error) {
 
-		addr, err := net.ResolveIPAddr("ip", this.Host)
+		addr, err := net.ResolveIPAddr(ipFamilyNetwork("ip", family), this.Host)
 		if err != nil {
-			return &pingStatus{}, nil
+			return &pingStatus{Err: err}, nil
 		}
 
-		pinger := fastping.NewPinger()
-		pinger.MaxRTT = timeout
-		pinger.AddIPAddr(addr)
+		pinger, err := openIcmpPinger(this.Mode, addr.IP.To4() == nil)
+		if err != nil {
+			return nil, err
+		}
+		defer pinger.Close()
 
-		statusCh := make(chan pingStatus)
-		errorCh := make(chan error)
+		var sent int
+		var rtts []time.Duration
 
-		pinger.OnRecv = func(addr *net.IPAddr, rtt time.Duration) {
-			statusCh <- pingStatus{ResolvedAddr: addr.IP, Online: true, Latency: rtt}
-		}
+		for seq := 1; seq <= this.Count && ctx.Err() == nil; seq++ {
 
-		go func() {
-			if err := pinger.Run(); err != nil {
-				errorCh <- err
-				return
+			packetStarted := time.Now()
+
+			//	split the remaining time between the packets that are left,
+			//	so that a single lost packet doesn't eat up the whole run
+			packetTimeout := this.PacketInterval
+			if deadline, has := ctx.Deadline(); has {
+				packetTimeout = max(packetTimeout, time.Until(deadline)/time.Duration(this.Count-seq+1))
 			}
-			statusCh <- pingStatus{ResolvedAddr: addr.IP}
-		}()
 
-		select {
+			packetCtx, cancelPacket := context.WithTimeout(ctx, packetTimeout)
+			rtt, err := pinger.Ping(packetCtx, addr, seq)
+			cancelPacket()
 
-		case status := <-statusCh:
-			return &status, nil
+			sent++
 
-		case err := <-errorCh:
-			return nil, err
+			if err == nil {
+				rtts = append(rtts, rtt)
+			} else if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				//	a missing reply is not an error, the packet is just lost
+				return &pingStatus{ResolvedAddr: addr.IP, Stats: newIcmpStats(sent, rtts), Err: err}, nil
+			}
 
-		case <-ctx.Done():
-			return &pingStatus{ResolvedAddr: addr.IP}, nil
+			if seq < this.Count {
+				select {
+				case <-time.After(time.Until(packetStarted.Add(this.PacketInterval))):
+				case <-ctx.Done():
+				}
+			}
 		}
+
+		return &pingStatus{ResolvedAddr: addr.IP, Stats: newIcmpStats(sent, rtts)}, nil
 	}
 
 	pingCtx, cancelPing := context.WithTimeout(ctx, timeout)
@@ -146,8 +199,8 @@ func (this *IcmpProbe) Exec(ctx context.Context) error {
 		return err
 	}
 
-	if status.ResolvedAddr != nil && !status.Online && this.IcmpProbeOptions.Retries > 0 {
-		for n := 0; n < this.IcmpProbeOptions.Retries && !status.Online && pingCtx.Err() == nil; n++ {
+	if status.ResolvedAddr != nil && status.Stats.Received == 0 && this.IcmpProbeOptions.Retries > 0 {
+		for n := 0; n < this.IcmpProbeOptions.Retries && status.Stats.Received == 0 && pingCtx.Err() == nil; n++ {
 			if status, err = fetchStatus(pingCtx); err != nil {
 				return err
 			}
@@ -159,7 +212,7 @@ func (this *IcmpProbe) Exec(ctx context.Context) error {
 		Timestamp:    time.Now(),
 		ProbeType:    this.Type(),
 		ProbeElapsed: time.Since(started),
-		Up:           status.Online,
+		IpFamily:     ipFamilyTag(family),
 	}
 
 	if status.ResolvedAddr != nil {
@@ -167,8 +220,20 @@ func (this *IcmpProbe) Exec(ctx context.Context) error {
 		entry.Host = &host
 	}
 
-	if status.Online {
-		entry.Latency = &status.Latency
+	if status.Stats.Sent > 0 {
+		entry.IcmpStats = &status.Stats
+	}
+
+	switch {
+	case status.Err != nil:
+		entry.setFailure(classifyError(status.Err), status.Err)
+	case status.Stats.Received == 0:
+		entry.setFailure(FailureTimeout, errors.New("no echo reply"))
+	case this.MaxLoss > 0 && status.Stats.Loss > this.MaxLoss:
+		entry.setFailure(FailurePacketLoss, fmt.Errorf("packet loss %.1f%% exceeds %.1f%%", status.Stats.Loss, this.MaxLoss))
+	default:
+		entry.Up = true
+		entry.Latency = &status.Stats.AvgRtt
 	}
 
 	if err := this.Writer.WriteUptime(ctx, entry); err != nil {
@@ -0,0 +1,271 @@
+package pulse
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	//	Picks unprivileged sockets when they're permitted and falls back to raw ones
+	IcmpModeAuto = "auto"
+	//	Raw sockets, requires root or CAP_NET_RAW
+	IcmpModePrivileged = "privileged"
+	//	Datagram sockets, requires the group to be allowed by net.ipv4.ping_group_range (linux and darwin only)
+	IcmpModeUnprivileged = "unprivileged"
+)
+
+const (
+	icmpProtoV4 = 1
+	icmpProtoV6 = 58
+)
+
+var errIcmpUnprivilegedDenied = errors.New("unprivileged icmp sockets are not permitted for this user; add its group to the 'net.ipv4.ping_group_range' sysctl or use the privileged mode")
+var errIcmpPrivilegedDenied = errors.New("raw icmp sockets require root or the CAP_NET_RAW capability; use the unprivileged mode with 'net.ipv4.ping_group_range' instead")
+
+// Sends icmp echo requests using either raw or datagram sockets
+type icmpPinger struct {
+	conn       *icmp.PacketConn
+	isIPv6     bool
+	isDatagram bool
+	id         int
+	token      []byte
+}
+
+func openIcmpPinger(mode string, isIPv6 bool) (*icmpPinger, error) {
+
+	var listen = func(privileged bool) (*icmpPinger, error) {
+
+		network, address := "udp4", "0.0.0.0"
+
+		switch {
+		case privileged && isIPv6:
+			network, address = "ip6:ipv6-icmp", "::"
+		case privileged:
+			network = "ip4:icmp"
+		case isIPv6:
+			network, address = "udp6", "::"
+		}
+
+		conn, err := icmp.ListenPacket(network, address)
+		if err != nil {
+
+			if isPermissionError(err) {
+				if privileged {
+					return nil, errIcmpPrivilegedDenied
+				}
+				return nil, errIcmpUnprivilegedDenied
+			}
+
+			return nil, err
+		}
+
+		token := make([]byte, 16)
+		rand.Read(token)
+
+		return &icmpPinger{
+			conn:       conn,
+			isIPv6:     isIPv6,
+			isDatagram: !privileged,
+			id:         os.Getpid() & 0xffff,
+			token:      token,
+		}, nil
+	}
+
+	switch mode {
+
+	case IcmpModePrivileged:
+		return listen(true)
+
+	case IcmpModeUnprivileged:
+		return listen(false)
+
+	default:
+
+		pinger, err := listen(false)
+		if errors.Is(err, errIcmpUnprivilegedDenied) {
+			if pinger, err = listen(true); errors.Is(err, errIcmpPrivilegedDenied) {
+				return nil, errors.New("icmp requires either root privileges or unprivileged icmp sockets enabled via the 'net.ipv4.ping_group_range' sysctl")
+			}
+		}
+
+		return pinger, err
+	}
+}
+
+func (this *icmpPinger) Close() error {
+	return this.conn.Close()
+}
+
+// Sends a single echo request and waits for the reply until the context is done
+func (this *icmpPinger) Ping(ctx context.Context, addr *net.IPAddr, seq int) (time.Duration, error) {
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{
+			ID:   this.id,
+			Seq:  seq,
+			Data: this.token,
+		},
+	}
+
+	if this.isIPv6 {
+		msg.Type = ipv6.ICMPTypeEchoRequest
+	}
+
+	packet, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var dst net.Addr = addr
+	if this.isDatagram {
+		dst = &net.UDPAddr{IP: addr.IP, Zone: addr.Zone}
+	}
+
+	if deadline, has := ctx.Deadline(); has {
+		this.conn.SetReadDeadline(deadline)
+	}
+
+	started := time.Now()
+
+	if _, err := this.conn.WriteTo(packet, dst); err != nil {
+		return 0, err
+	}
+
+	proto := icmpProtoV4
+	if this.isIPv6 {
+		proto = icmpProtoV6
+	}
+
+	buff := make([]byte, 1500)
+
+	for {
+
+		n, peer, err := this.conn.ReadFrom(buff)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, err
+		}
+
+		rtt := time.Since(started)
+
+		reply, err := icmp.ParseMessage(proto, buff[:n])
+		if err != nil {
+			continue
+		}
+
+		if reply.Type != ipv4.ICMPTypeEchoReply && reply.Type != ipv6.ICMPTypeEchoReply {
+			continue
+		}
+
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || !bytes.Equal(echo.Data, this.token) {
+			continue
+		}
+
+		//	the kernel replaces echo id with the local port for datagram sockets
+		if !this.isDatagram && echo.ID != this.id {
+			continue
+		}
+
+		if !icmpPeerMatches(peer, addr.IP) {
+			continue
+		}
+
+		return rtt, nil
+	}
+}
+
+// Calculates packet loss and rtt statistics
+func newIcmpStats(sent int, rtts []time.Duration) IcmpStats {
+
+	stats := IcmpStats{
+		Sent:     sent,
+		Received: len(rtts),
+	}
+
+	if sent > 0 {
+		stats.Loss = float64(sent-len(rtts)) / float64(sent) * 100
+	}
+
+	if len(rtts) == 0 {
+		return stats
+	}
+
+	stats.MinRtt, stats.MaxRtt = rtts[0], rtts[0]
+
+	var sum time.Duration
+	var jitterSum time.Duration
+
+	for idx, rtt := range rtts {
+
+		sum += rtt
+		stats.MinRtt = min(stats.MinRtt, rtt)
+		stats.MaxRtt = max(stats.MaxRtt, rtt)
+
+		if idx > 0 {
+			diff := rtt - rtts[idx-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			jitterSum += diff
+		}
+	}
+
+	stats.AvgRtt = sum / time.Duration(len(rtts))
+
+	var variance float64
+	for _, rtt := range rtts {
+		delta := float64(rtt - stats.AvgRtt)
+		variance += delta * delta
+	}
+
+	stats.StdDevRtt = time.Duration(math.Sqrt(variance / float64(len(rtts))))
+
+	//	jitter is the mean difference between consecutive rtts
+	if len(rtts) > 1 {
+		stats.Jitter = jitterSum / time.Duration(len(rtts)-1)
+	}
+
+	return stats
+}
+
+func icmpPeerMatches(peer net.Addr, ip net.IP) bool {
+	switch peer := peer.(type) {
+	case *net.IPAddr:
+		return peer.IP.Equal(ip)
+	case *net.UDPAddr:
+		return peer.IP.Equal(ip)
+	default:
+		return false
+	}
+}
+
+func isPermissionError(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, os.ErrPermission)
+}
+
+func validateIcmpMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return IcmpModeAuto, nil
+	case IcmpModeAuto, IcmpModePrivileged, IcmpModeUnprivileged:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported icmp mode '%s'", mode)
+	}
+}
@@ -2,16 +2,22 @@ package pulse
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Line protocol measurement that all of the entries are written to
+const influxMeasurement = "pulse_uptime"
+
 func NewInfluxStorage(influxUrl string) (*influxStorage, error) {
 
 	baseUrl, err := url.Parse(influxUrl)
@@ -28,10 +34,13 @@ func NewInfluxStorage(influxUrl string) (*influxStorage, error) {
 		return nil, fmt.Errorf("unsupported protocol scheme '%s'", baseUrl.Scheme)
 	}
 
-	this := influxStorage{baseUrl: url.URL{
-		Scheme: baseUrl.Scheme,
-		Host:   baseUrl.Host,
-	}}
+	this := influxStorage{
+		baseUrl: url.URL{
+			Scheme: baseUrl.Scheme,
+			Host:   baseUrl.Host,
+		},
+		precision: time.Nanosecond,
+	}
 
 	//	this is stupid but the basic auth doesn't work here anyway;
 	//	so for now we just grab any password that's provided and set it as the Token
@@ -50,6 +59,19 @@ func NewInfluxStorage(influxUrl string) (*influxStorage, error) {
 		this.dbName = dbname
 	}
 
+	params := baseUrl.Query()
+
+	//	setting an org switches the client to the v2 api, in which case the database name is used as the bucket name
+	if org := params.Get("org"); org != "" {
+		this.org = &org
+	}
+
+	if val := params.Get("precision"); val != "" {
+		if this.precision, err = influxParsePrecision(val); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := this.Ping(context.Background()); err != nil {
 		return nil, fmt.Errorf("unable to connect: %v", err)
 	}
@@ -61,6 +83,8 @@ type influxStorage struct {
 	baseUrl   url.URL
 	dbName    string
 	tokenAuth *string
+	org       *string
+	precision time.Duration
 }
 
 // Returns client TypeID
@@ -70,9 +94,17 @@ func (this *influxStorage) Type() string {
 
 // Returns client version
 func (this *influxStorage) Version() string {
+	if this.org != nil {
+		return "v2"
+	}
 	return "v1"
 }
 
+// Points that are written again overwrite the existing ones, so a failed batch can be retried as a whole
+func (this *influxStorage) AtomicBatches() bool {
+	return true
+}
+
 func (this *influxStorage) fetch(ctx context.Context, method string, url *url.URL, body io.Reader) (*http.Response, error) {
 
 	req, err := http.NewRequest(method, url.String(), body)
@@ -91,12 +123,25 @@ func (this *influxStorage) fetch(ctx context.Context, method string, url *url.UR
 // This is not a health check, the goal of Ping() is to ensure that the client is correctly initialized
 func (this *influxStorage) Ping(ctx context.Context) error {
 
-	params := this.baseUrl.Query()
-	params.Add("q", "SHOW DATABASES")
-
 	queryUrl := this.baseUrl
-	queryUrl.Path = "/query"
-	queryUrl.RawQuery = params.Encode()
+
+	if this.org != nil {
+
+		params := url.Values{}
+		params.Set("org", *this.org)
+		params.Set("name", this.dbName)
+
+		queryUrl.Path = "/api/v2/buckets"
+		queryUrl.RawQuery = params.Encode()
+
+	} else {
+
+		params := url.Values{}
+		params.Add("q", "SHOW DATABASES")
+
+		queryUrl.Path = "/query"
+		queryUrl.RawQuery = params.Encode()
+	}
 
 	resp, err := this.fetch(ctx, "GET", &queryUrl, nil)
 	if err != nil {
@@ -115,37 +160,61 @@ func (this *influxStorage) Ping(ctx context.Context) error {
 		return influxFmtStatusError(resp.StatusCode)
 	}
 
+	if this.org != nil {
+
+		var payload struct {
+			Buckets []struct {
+				Name string `json:"name"`
+			} `json:"buckets"`
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+			return fmt.Errorf("failed to decode buckets list: %v", err)
+		}
+
+		if len(payload.Buckets) == 0 {
+			return fmt.Errorf("bucket '%s' not found", this.dbName)
+		}
+	}
+
 	return nil
 }
 
 // Writes a single uptime metric
 func (this *influxStorage) WriteUptime(ctx context.Context, entry UptimeEntry) error {
+	return this.write(ctx, strings.NewReader(influxEntryLiner(entry).Line(this.precision)))
+}
 
-	params := url.Values{}
-	params.Set("db", this.dbName)
+// Writes multiple uptime metrics in a single request
+func (this *influxStorage) WriteUptimeBatch(ctx context.Context, entries []UptimeEntry) error {
 
-	pushUrl := this.baseUrl
-	pushUrl.Path = "/write"
-	pushUrl.RawQuery = params.Encode()
-
-	liner := influxLiner{
-		Labels: map[string]string{
-			"probe":      entry.Label,
-			"probe_type": entry.ProbeType,
-		},
+	var lines []string
+	for _, entry := range entries {
+		lines = append(lines, influxEntryLiner(entry).Line(this.precision))
 	}
 
-	if entry.Host != nil {
-		liner.Labels["host"] = *entry.Host
+	return this.write(ctx, strings.NewReader(strings.Join(lines, "\n")))
+}
+
+func (this *influxStorage) write(ctx context.Context, body io.Reader) error {
+
+	params := url.Values{}
+	pushUrl := this.baseUrl
+
+	if this.org != nil {
+		pushUrl.Path = "/api/v2/write"
+		params.Set("org", *this.org)
+		params.Set("bucket", this.dbName)
+		params.Set("precision", influxPrecisionName(this.precision, false))
+	} else {
+		pushUrl.Path = "/write"
+		params.Set("db", this.dbName)
+		params.Set("precision", influxPrecisionName(this.precision, true))
 	}
 
-	liner.WriteDuration("probe_elapsed", entry.ProbeElapsed)
-	liner.WriteBool("up", entry.Up)
-	liner.WriteDuration("latency", entry.FillLatency())
-	liner.WriteInt("http_status", int64(entry.FillHttpStatus()))
-	liner.WriteInt("tls_version", int64(entry.FillTlsVersion()))
+	pushUrl.RawQuery = params.Encode()
 
-	resp, err := this.fetch(ctx, "POST", &pushUrl, liner.Reader())
+	resp, err := this.fetch(ctx, "POST", &pushUrl, body)
 	if err != nil {
 		return err
 	}
@@ -164,56 +233,212 @@ func (this *influxStorage) WriteUptime(ctx context.Context, entry UptimeEntry) e
 	return nil
 }
 
-type influxLiner struct {
-	Labels map[string]string
+func influxEntryLiner(entry UptimeEntry) *influxLiner {
+
+	liner := influxLiner{
+		Measurement: influxMeasurement,
+		Tags: map[string]string{
+			"probe":      entry.Label,
+			"probe_type": entry.ProbeType,
+		},
+		Timestamp: entry.Timestamp,
+	}
 
-	builder strings.Builder
+	if entry.Host != nil {
+		liner.Tags["host"] = *entry.Host
+	}
+
+	if entry.IpFamily != nil {
+		liner.Tags["ip_family"] = *entry.IpFamily
+	}
+
+	if entry.FailureKind != nil {
+		liner.Tags["failure_kind"] = string(*entry.FailureKind)
+	}
+
+	liner.WriteBool("up", entry.Up)
+	liner.WriteDuration("probe_elapsed", entry.ProbeElapsed)
+
+	//	error messages are unique enough to blow up the series cardinality, so they're stored as a field
+	if entry.Error != nil {
+		liner.WriteString("error", *entry.Error)
+	}
+
+	if entry.Latency != nil {
+		liner.WriteDuration("latency", *entry.Latency)
+	}
+
+	if entry.HttpStatus != nil {
+		liner.WriteInt("http_status", int64(*entry.HttpStatus))
+	}
+
+	if entry.TlsVersion != nil {
+		liner.WriteInt("tls_version", int64(*entry.TlsVersion))
+	}
+
+	if timings := entry.HttpTimings; timings != nil {
+		liner.WriteDuration("timing_dns", timings.Dns)
+		liner.WriteDuration("timing_connect", timings.Connect)
+		liner.WriteDuration("timing_tls", timings.Tls)
+		liner.WriteDuration("timing_ttfb", timings.Ttfb)
+		liner.WriteDuration("timing_transfer", timings.Transfer)
+	}
+
+	if entry.TlsCert != nil {
+		liner.WriteInt("tls_cert_days_left", int64(entry.TlsCert.DaysLeft))
+		liner.WriteBool("tls_cert_valid", entry.TlsCert.Valid)
+	}
+
+	if entry.IcmpStats != nil {
+		liner.WriteInt("icmp_sent", int64(entry.IcmpStats.Sent))
+		liner.WriteInt("icmp_received", int64(entry.IcmpStats.Received))
+		liner.WriteFloat("icmp_loss", entry.IcmpStats.Loss)
+		liner.WriteFloat("icmp_rtt_min", durationMillis(entry.IcmpStats.MinRtt))
+		liner.WriteFloat("icmp_rtt_avg", durationMillis(entry.IcmpStats.AvgRtt))
+		liner.WriteFloat("icmp_rtt_max", durationMillis(entry.IcmpStats.MaxRtt))
+		liner.WriteFloat("icmp_rtt_stddev", durationMillis(entry.IcmpStats.StdDevRtt))
+		liner.WriteFloat("icmp_jitter", durationMillis(entry.IcmpStats.Jitter))
+	}
+
+	return &liner
 }
 
-func (this *influxLiner) Reader() io.Reader {
-	return strings.NewReader(this.builder.String())
+// Builds a single line protocol point
+type influxLiner struct {
+	Measurement string
+	Tags        map[string]string
+	//	Point timestamp, defaults to the current time
+	Timestamp time.Time
+
+	fields []string
 }
 
-func (this *influxLiner) write(key string, value any) {
+// Returns the encoded point, with the timestamp truncated to the precision
+func (this *influxLiner) Line(precision time.Duration) string {
+
+	var builder strings.Builder
+
+	builder.WriteString(influxEscape(this.Measurement, ", "))
 
-	var line strings.Builder
+	//	sorted tags are recommended by the spec for better write performance
+	var keys []string
+	for key, val := range this.Tags {
+		//	empty tag values are not allowed
+		if val != "" {
+			keys = append(keys, key)
+		}
+	}
 
-	line.WriteString(url.QueryEscape(key))
+	sort.Strings(keys)
 
-	for key, val := range this.Labels {
-		line.WriteString(fmt.Sprintf(",%s=%s", url.QueryEscape(key), url.QueryEscape(val)))
+	for _, key := range keys {
+		builder.WriteByte(',')
+		builder.WriteString(influxEscape(key, ",= "))
+		builder.WriteByte('=')
+		builder.WriteString(influxEscape(this.Tags[key], ",= "))
 	}
 
-	line.WriteString(fmt.Sprintf(" value=%d %d", value, time.Now().UnixNano()))
+	builder.WriteByte(' ')
+	builder.WriteString(strings.Join(this.fields, ","))
 
-	if this.builder.Len() > 0 {
-		this.builder.WriteRune('\n')
+	timestamp := this.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
 	}
 
-	this.builder.WriteString(line.String())
+	builder.WriteByte(' ')
+	builder.WriteString(strconv.FormatInt(timestamp.UnixNano()/int64(precision), 10))
+
+	return builder.String()
+}
+
+func (this *influxLiner) write(key string, value string) {
+	this.fields = append(this.fields, influxEscape(key, ",= ")+"="+value)
 }
 
 func (this *influxLiner) WriteInt(key string, value int64) {
-	this.write(key, value)
+	this.write(key, strconv.FormatInt(value, 10)+"i")
 }
 
 func (this *influxLiner) WriteDuration(key string, value time.Duration) {
-	this.write(key, value.Milliseconds())
+	this.WriteInt(key, value.Milliseconds())
 }
 
 func (this *influxLiner) WriteFloat(key string, value float64) {
-	this.write(key, value)
+	this.write(key, strconv.FormatFloat(value, 'f', -1, 64))
 }
 
 func (this *influxLiner) WriteBool(key string, value bool) {
-	if value {
-		this.write(key, 1)
-	} else {
-		this.write(key, 0)
+	this.write(key, strconv.FormatBool(value))
+}
+
+func (this *influxLiner) WriteString(key string, value string) {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", " ").Replace(value)
+	this.write(key, `"`+value+`"`)
+}
+
+// Escapes the special characters with a backslash. Backslashes are escaped too, so that a trailing one can't escape the separator
+// that follows the value. Newlines aren't allowed anywhere, so they're replaced with spaces
+func influxEscape(val string, special string) string {
+
+	var builder strings.Builder
+
+	for _, char := range val {
+
+		switch {
+		case char == '\n' || char == '\r':
+			builder.WriteByte(' ')
+			continue
+		case char == '\\' || strings.ContainsRune(special, char):
+			builder.WriteByte('\\')
+		}
+
+		builder.WriteRune(char)
+	}
+
+	return builder.String()
+}
+
+func influxParsePrecision(val string) (time.Duration, error) {
+	switch val {
+	case "ns", "n":
+		return time.Nanosecond, nil
+	case "us", "u":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	default:
+		return 0, fmt.Errorf("unsupported precision '%s'", val)
+	}
+}
+
+// Returns precision name for the write api. v1 uses a shorter format for ns and us
+func influxPrecisionName(precision time.Duration, isV1 bool) string {
+	switch precision {
+	case time.Second:
+		return "s"
+	case time.Millisecond:
+		return "ms"
+	case time.Microsecond:
+		if isV1 {
+			return "u"
+		}
+		return "us"
+	default:
+		if isV1 {
+			return "n"
+		}
+		return "ns"
 	}
 }
 
 func influxFmtStatusError(status int) error {
+	return httpStatusError(status, influxStatusMessage(status))
+}
+
+func influxStatusMessage(status int) error {
 	switch status {
 
 	case http.StatusBadRequest:
@@ -0,0 +1,94 @@
+package pulse
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	//	Use whatever address family the resolver returns
+	IpFamilyAny = "any"
+	//	IPv4 only
+	IpFamily4 = "ip4"
+	//	IPv6 only
+	IpFamily6 = "ip6"
+	//	Check both IPv4 and IPv6, emitting an entry for each of them
+	IpFamilyBoth = "both"
+)
+
+func validateIpFamily(val string) (string, error) {
+
+	val = strings.ToLower(val)
+
+	switch val {
+	case "":
+		return IpFamilyAny, nil
+	case "ipv4", "4":
+		return IpFamily4, nil
+	case "ipv6", "6":
+		return IpFamily6, nil
+	case IpFamilyAny, IpFamily4, IpFamily6, IpFamilyBoth:
+		return val, nil
+	default:
+		return "", fmt.Errorf("unsupported ip family '%s'", val)
+	}
+}
+
+// Expands the 'both' option into the individual families
+func expandIpFamily(val string) []string {
+	if val == IpFamilyBoth {
+		return []string{IpFamily4, IpFamily6}
+	}
+	return []string{val}
+}
+
+// Narrows a network name (tcp, udp, ip) down to the address family: ("tcp", "ip6") -> "tcp6"
+func ipFamilyNetwork(network string, family string) string {
+
+	network = strings.TrimRight(network, "46")
+
+	switch family {
+	case IpFamily4:
+		return network + "4"
+	case IpFamily6:
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+// Returns a pointer to the family value that should be set on an entry (nil for the 'any' family)
+func ipFamilyTag(family string) *string {
+	if family == IpFamilyAny || family == "" {
+		return nil
+	}
+	return &family
+}
+
+// Runs the callback for every family from the expanded option concurrently
+func execIpFamilies(family string, fn func(family string) error) error {
+
+	families := expandIpFamily(family)
+	if len(families) == 1 {
+		return fn(families[0])
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(families))
+
+	for idx, family := range families {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(family); err != nil {
+				errs[idx] = fmt.Errorf("%s: %v", family, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,82 @@
+package pulse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Creates a writer that fans out every entry to all of the provided writers
+func NewMultiWriter(writers ...StorageWriter) *MultiWriter {
+	return &MultiWriter{writers: writers}
+}
+
+type MultiWriter struct {
+	writers []StorageWriter
+}
+
+// Returns client TypeID
+func (this *MultiWriter) Type() string {
+	return "multi"
+}
+
+// Returns versions of all the nested writers
+func (this *MultiWriter) Version() string {
+
+	var versions []string
+	for _, writer := range this.writers {
+		versions = append(versions, writer.Type()+"/"+writer.Version())
+	}
+
+	return strings.Join(versions, ",")
+}
+
+// Returns the nested writers
+func (this *MultiWriter) Writers() []StorageWriter {
+	return this.writers
+}
+
+// Writes a single uptime metric to every writer concurrently.
+// A failing writer doesn't affect the others; their errors are joined together and stay inspectable with errors.Is/As
+func (this *MultiWriter) WriteUptime(ctx context.Context, entry UptimeEntry) error {
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(this.writers))
+
+	for idx, writer := range this.writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := writer.WriteUptime(ctx, entry); err != nil {
+				errs[idx] = fmt.Errorf("%s: %w", writer.Type(), err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// Writes multiple uptime metrics to every writer concurrently
+func (this *MultiWriter) WriteUptimeBatch(ctx context.Context, entries []UptimeEntry) error {
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(this.writers))
+
+	for idx, writer := range this.writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := WriteUptimeBatch(ctx, writer, entries); err != nil {
+				errs[idx] = fmt.Errorf("%s: %w", writer.Type(), err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
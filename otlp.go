@@ -0,0 +1,499 @@
+package pulse
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the histogram series are tracked after their last update
+const otlpSeriesTTL = 24 * time.Hour
+
+type OtlpOptions struct {
+	//	Extra request headers, usually used for authentication
+	Headers map[string]string
+	//	Resource attributes that describe this pulse instance (location, environment etc)
+	Attributes map[string]string
+}
+
+// Creates a writer that sends metrics to an OpenTelemetry collector over OTLP/HTTP using JSON encoding
+func NewOtlpStorage(endpoint string, opts OtlpOptions) (*otlpStorage, error) {
+
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpointUrl.Host == "" {
+		return nil, fmt.Errorf("missing url host")
+	}
+
+	switch endpointUrl.Scheme {
+	case "":
+		endpointUrl.Scheme = "http"
+	case "http", "https":
+		break
+	default:
+		return nil, fmt.Errorf("unsupported protocol scheme '%s'", endpointUrl.Scheme)
+	}
+
+	//	same as the otel sdk: a base url gets the signal path appended
+	if endpointUrl.Path == "" || endpointUrl.Path == "/" {
+		endpointUrl.Path = "/v1/metrics"
+	}
+
+	attributes := map[string]string{
+		"service.name": "pulse",
+	}
+
+	for key, val := range opts.Attributes {
+		attributes[key] = val
+	}
+
+	return &otlpStorage{
+		endpoint:   *endpointUrl,
+		headers:    opts.Headers,
+		resource:   otlpAttributes(attributes),
+		lastPoints: map[string]time.Time{},
+	}, nil
+}
+
+type otlpStorage struct {
+	endpoint url.URL
+	headers  map[string]string
+	resource []otlpKeyValue
+
+	//	end time of the last histogram point of every series, used as the start time of the next delta
+	mtx        sync.Mutex
+	lastPoints map[string]time.Time
+}
+
+// Returns client TypeID
+func (this *otlpStorage) Type() string {
+	return "otlp"
+}
+
+// Returns client version
+func (this *otlpStorage) Version() string {
+	return "v1"
+}
+
+// Writes a single uptime metric
+func (this *otlpStorage) WriteUptime(ctx context.Context, entry UptimeEntry) error {
+	return this.WriteUptimeBatch(ctx, []UptimeEntry{entry})
+}
+
+// Writes multiple uptime metrics in a single request
+func (this *otlpStorage) WriteUptimeBatch(ctx context.Context, entries []UptimeEntry) error {
+
+	builder := otlpMetricsBuilder{metrics: map[string]*otlpMetric{}}
+
+	this.mtx.Lock()
+	for _, entry := range entries {
+		this.addEntry(&builder, entry)
+	}
+	this.pruneLastPoints()
+	this.mtx.Unlock()
+
+	payload := otlpExportRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResource{Attributes: this.resource},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: "pulse"},
+				Metrics: builder.Metrics(),
+			}},
+		}},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", this.endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for key, val := range this.headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+
+		if body, err := io.ReadAll(resp.Body); err == nil {
+			slog.Debug("OTLP: Request error",
+				slog.String("body", string(body)))
+		}
+
+		return httpStatusError(resp.StatusCode, fmt.Errorf("unexpected status code: %d", resp.StatusCode))
+	}
+
+	var result struct {
+		PartialSuccess *struct {
+			RejectedDataPoints json.Number `json:"rejectedDataPoints"`
+			ErrorMessage       string      `json:"errorMessage"`
+		} `json:"partialSuccess"`
+	}
+
+	//	the response body is optional, so decoding errors are not a concern here
+	if json.NewDecoder(resp.Body).Decode(&result) == nil && result.PartialSuccess != nil {
+		if rejected, _ := result.PartialSuccess.RejectedDataPoints.Int64(); rejected > 0 {
+			return fmt.Errorf("%d data points rejected: %s", rejected, result.PartialSuccess.ErrorMessage)
+		}
+	}
+
+	return nil
+}
+
+// Forgets the series that haven't been updated for a while, like the ones of the removed probes.
+// A series that comes back after that just starts a new delta
+func (this *otlpStorage) pruneLastPoints() {
+
+	deadline := time.Now().Add(-otlpSeriesTTL)
+
+	for key, last := range this.lastPoints {
+		if last.Before(deadline) {
+			delete(this.lastPoints, key)
+		}
+	}
+}
+
+func (this *otlpStorage) addEntry(builder *otlpMetricsBuilder, entry UptimeEntry) {
+
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+
+	//	host addresses change with dns records, so they're not a part of the series identity
+	labels := map[string]string{
+		"probe.label": entry.Label,
+		"probe.type":  entry.ProbeType,
+	}
+
+	if entry.IpFamily != nil {
+		labels["probe.ip_family"] = *entry.IpFamily
+	}
+
+	attributes := otlpAttributes(labels)
+	timestamp := otlpTimestamp(entry.Timestamp)
+
+	var gauge = func(name, unit, description string, point otlpNumberDataPoint) {
+		point.Attributes = attributes
+		point.TimeUnixNano = timestamp
+		builder.Gauge(name, unit, description, point)
+	}
+
+	var intValue = func(val int64) otlpNumberDataPoint {
+		str := strconv.FormatInt(val, 10)
+		return otlpNumberDataPoint{AsInt: &str}
+	}
+
+	var doubleValue = func(val float64) otlpNumberDataPoint {
+		return otlpNumberDataPoint{AsDouble: &val}
+	}
+
+	var boolValue = func(val bool) otlpNumberDataPoint {
+		if val {
+			return intValue(1)
+		}
+		return intValue(0)
+	}
+
+	gauge("pulse.up", "1", "Whether the service was up during the last probe run", boolValue(entry.Up))
+
+	//	failure reason is a separate metric, so that pulse.up stays a single series when the state changes
+	if entry.FailureKind != nil {
+
+		failureLabels := map[string]string{"failure.kind": string(*entry.FailureKind)}
+		for key, val := range labels {
+			failureLabels[key] = val
+		}
+
+		builder.Gauge("pulse.failure", "1", "Set for failed probe runs, with the failure reason as an attribute", otlpNumberDataPoint{
+			Attributes:   otlpAttributes(failureLabels),
+			TimeUnixNano: timestamp,
+			AsInt:        intValue(1).AsInt,
+		})
+	}
+
+	//	the address goes to an info metric instead, same as target_info does for the resource attributes
+	if entry.Host != nil {
+
+		infoLabels := map[string]string{"probe.host": *entry.Host}
+		for key, val := range labels {
+			infoLabels[key] = val
+		}
+
+		builder.Gauge("pulse.probe.info", "1", "Always 1, with the address of the probed host as an attribute", otlpNumberDataPoint{
+			Attributes:   otlpAttributes(infoLabels),
+			TimeUnixNano: timestamp,
+			AsInt:        intValue(1).AsInt,
+		})
+	}
+
+	gauge("pulse.probe.duration", "s", "Time the probe run took", doubleValue(entry.ProbeElapsed.Seconds()))
+
+	if entry.HttpStatus != nil {
+		gauge("pulse.http.status", "1", "Returned HTTP status code", intValue(int64(*entry.HttpStatus)))
+	}
+
+	if entry.TlsVersion != nil {
+		gauge("pulse.tls.version", "1", "Used TLS version", intValue(int64(*entry.TlsVersion)))
+	}
+
+	if entry.TlsCert != nil {
+		gauge("pulse.tls.cert.days_left", "d", "Number of full days left until the server certificate expires", intValue(int64(entry.TlsCert.DaysLeft)))
+		gauge("pulse.tls.cert.valid", "1", "Whether the server certificate chain is valid", boolValue(entry.TlsCert.Valid))
+	}
+
+	if entry.IcmpStats != nil {
+		gauge("pulse.icmp.loss", "1", "ICMP packet loss ratio", doubleValue(entry.IcmpStats.Loss/100))
+		gauge("pulse.icmp.jitter", "s", "ICMP round trip time jitter", doubleValue(entry.IcmpStats.Jitter.Seconds()))
+	}
+
+	if entry.Latency == nil {
+		return
+	}
+
+	//	every entry is a separate delta, that starts where the previous one of the same series has ended
+	seriesKey := otlpSeriesKey(attributes)
+
+	started := entry.Timestamp.Add(-entry.ProbeElapsed)
+	if last, has := this.lastPoints[seriesKey]; has && last.Before(entry.Timestamp) {
+		started = last
+	}
+
+	if last := this.lastPoints[seriesKey]; entry.Timestamp.After(last) {
+		this.lastPoints[seriesKey] = entry.Timestamp
+	}
+
+	latency := entry.Latency.Seconds()
+
+	bucketCounts := make([]string, len(exporterLatencyBuckets)+1)
+	for idx := range bucketCounts {
+		bucketCounts[idx] = "0"
+	}
+
+	bucketIdx := sort.SearchFloat64s(exporterLatencyBuckets, latency)
+	bucketCounts[bucketIdx] = "1"
+
+	builder.Histogram("pulse.latency", "s", "Service latency", otlpHistogramDataPoint{
+		Attributes:        attributes,
+		StartTimeUnixNano: otlpTimestamp(started),
+		TimeUnixNano:      timestamp,
+		Count:             "1",
+		Sum:               latency,
+		Min:               latency,
+		Max:               latency,
+		BucketCounts:      bucketCounts,
+		ExplicitBounds:    exporterLatencyBuckets,
+	})
+}
+
+// Collects data points into metrics, preserving the order in which the metrics were added
+type otlpMetricsBuilder struct {
+	names   []string
+	metrics map[string]*otlpMetric
+}
+
+func (this *otlpMetricsBuilder) metric(name, unit, description string) *otlpMetric {
+
+	if metric, has := this.metrics[name]; has {
+		return metric
+	}
+
+	metric := &otlpMetric{Name: name, Unit: unit, Description: description}
+	this.metrics[name] = metric
+	this.names = append(this.names, name)
+
+	return metric
+}
+
+func (this *otlpMetricsBuilder) Gauge(name, unit, description string, point otlpNumberDataPoint) {
+
+	metric := this.metric(name, unit, description)
+	if metric.Gauge == nil {
+		metric.Gauge = &otlpGauge{}
+	}
+
+	metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, point)
+}
+
+func (this *otlpMetricsBuilder) Histogram(name, unit, description string, point otlpHistogramDataPoint) {
+
+	metric := this.metric(name, unit, description)
+	if metric.Histogram == nil {
+		metric.Histogram = &otlpHistogram{AggregationTemporality: otlpTemporalityDelta}
+	}
+
+	metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, point)
+}
+
+func (this *otlpMetricsBuilder) Metrics() []otlpMetric {
+
+	var result []otlpMetric
+	for _, name := range this.names {
+		result = append(result, *this.metrics[name])
+	}
+
+	return result
+}
+
+// Converts a string map into a sorted attribute list
+func otlpAttributes(attrs map[string]string) []otlpKeyValue {
+
+	var result []otlpKeyValue
+	for key, val := range attrs {
+		result = append(result, otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: val}})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+
+	return result
+}
+
+// Identifies a series by its attribute set
+func otlpSeriesKey(attrs []otlpKeyValue) string {
+
+	var key strings.Builder
+	for _, attr := range attrs {
+		key.WriteString(attr.Key)
+		key.WriteByte('=')
+		key.WriteString(attr.Value.StringValue)
+		key.WriteByte(0)
+	}
+
+	return key.String()
+}
+
+// 64-bit integers are encoded as strings in OTLP JSON
+func otlpTimestamp(val time.Time) string {
+	return strconv.FormatInt(val.UnixNano(), 10)
+}
+
+// Parses a 'key1=value1,key2=value2' list, the format used by the OTEL_EXPORTER_OTLP_HEADERS and OTEL_RESOURCE_ATTRIBUTES variables
+func ParseOtlpKeyValues(val string) (map[string]string, error) {
+
+	result := map[string]string{}
+
+	for _, pair := range strings.Split(val, ",") {
+
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		key, value, has := strings.Cut(pair, "=")
+		if !has {
+			return nil, fmt.Errorf("invalid key-value pair '%s'", pair)
+		}
+
+		key, err := url.QueryUnescape(strings.TrimSpace(key))
+		if err != nil {
+			return nil, err
+		}
+
+		value, err = url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+
+		if key == "" {
+			return nil, errors.New("empty key")
+		}
+
+		result[key] = value
+	}
+
+	return result, nil
+}
+
+const otlpTemporalityDelta = 1
+
+type otlpExportRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	TimeUnixNano string         `json:"timeUnixNano"`
+	AsInt        *string        `json:"asInt,omitempty"`
+	AsDouble     *float64       `json:"asDouble,omitempty"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	Min               float64        `json:"min"`
+	Max               float64        `json:"max"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
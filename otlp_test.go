@@ -0,0 +1,163 @@
+package pulse
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOtlpExport(t *testing.T) {
+
+	var requests []otlpExportRequest
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path != "/v1/metrics" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+
+		if val := r.Header.Get("Content-Type"); val != "application/json" {
+			t.Errorf("unexpected content type: %s", val)
+		}
+
+		var payload otlpExportRequest
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decode: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		requests = append(requests, payload)
+	}))
+	defer receiver.Close()
+
+	storage, err := NewOtlpStorage(receiver.URL, OtlpOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Now().Add(-time.Hour)
+	latency := 120 * time.Millisecond
+	kind := FailureTimeout
+
+	entries := []UptimeEntry{
+		{
+			Label:        "example",
+			ProbeType:    "http",
+			Timestamp:    started,
+			ProbeElapsed: latency,
+			Up:           true,
+			Latency:      &latency,
+			Host:         ptr("192.0.2.1"),
+		},
+		{
+			Label:        "example",
+			ProbeType:    "http",
+			Timestamp:    started.Add(time.Minute),
+			ProbeElapsed: time.Second,
+			FailureKind:  &kind,
+			Host:         ptr("192.0.2.2"),
+		},
+		{
+			Label:        "example",
+			ProbeType:    "http",
+			Timestamp:    started.Add(2 * time.Minute),
+			ProbeElapsed: latency,
+			Up:           true,
+			Latency:      &latency,
+			Host:         ptr("192.0.2.2"),
+		},
+	}
+
+	for _, entry := range entries {
+		if err := storage.WriteUptime(context.Background(), entry); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	if len(requests) != len(entries) {
+		t.Fatalf("expected %d requests, got %d", len(entries), len(requests))
+	}
+
+	var metrics = func(req otlpExportRequest) map[string]otlpMetric {
+		result := map[string]otlpMetric{}
+		for _, metric := range req.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			result[metric.Name] = metric
+		}
+		return result
+	}
+
+	var attrs = func(list []otlpKeyValue) map[string]string {
+		result := map[string]string{}
+		for _, item := range list {
+			result[item.Key] = item.Value.StringValue
+		}
+		return result
+	}
+
+	first := metrics(requests[0])
+	for _, name := range []string{"pulse.up", "pulse.probe.info", "pulse.probe.duration", "pulse.latency"} {
+		if _, has := first[name]; !has {
+			t.Errorf("metric %s is missing", name)
+		}
+	}
+
+	if _, has := first["pulse.failure"]; has {
+		t.Errorf("unexpected pulse.failure metric for a successful run")
+	}
+
+	if resource := attrs(requests[0].ResourceMetrics[0].Resource.Attributes); resource["service.name"] != "pulse" {
+		t.Errorf("unexpected resource attributes: %v", resource)
+	}
+
+	//	the series identity must not change when the host address or the state do
+	for idx, req := range requests {
+
+		up := metrics(req)["pulse.up"]
+		if up.Gauge == nil || len(up.Gauge.DataPoints) != 1 {
+			t.Fatalf("request %d: pulse.up is not a single gauge point", idx)
+		}
+
+		got := attrs(up.Gauge.DataPoints[0].Attributes)
+		if len(got) != 2 || got["probe.label"] != "example" || got["probe.type"] != "http" {
+			t.Errorf("request %d: unexpected pulse.up attributes: %v", idx, got)
+		}
+
+		info := metrics(req)["pulse.probe.info"]
+		if info.Gauge == nil || attrs(info.Gauge.DataPoints[0].Attributes)["probe.host"] != *entries[idx].Host {
+			t.Errorf("request %d: probe.host is missing from pulse.probe.info", idx)
+		}
+	}
+
+	failure := metrics(requests[1])["pulse.failure"]
+	if failure.Gauge == nil || attrs(failure.Gauge.DataPoints[0].Attributes)["failure.kind"] != string(FailureTimeout) {
+		t.Errorf("unexpected pulse.failure metric: %+v", failure)
+	}
+
+	firstHist := first["pulse.latency"].Histogram
+	lastHist := metrics(requests[2])["pulse.latency"].Histogram
+
+	if firstHist == nil || lastHist == nil {
+		t.Fatal("pulse.latency is not a histogram")
+	}
+
+	if firstHist.AggregationTemporality != otlpTemporalityDelta || lastHist.AggregationTemporality != otlpTemporalityDelta {
+		t.Errorf("expected delta temporality, got %d and %d", firstHist.AggregationTemporality, lastHist.AggregationTemporality)
+	}
+
+	//	deltas of the same series are continuous, even though the host address has changed in between
+	if val := lastHist.DataPoints[0].StartTimeUnixNano; val != firstHist.DataPoints[0].TimeUnixNano {
+		t.Errorf("expected the delta to start at %s, got %s", firstHist.DataPoints[0].TimeUnixNano, val)
+	}
+
+	if val := firstHist.DataPoints[0].Count; val != "1" {
+		t.Errorf("unexpected histogram count: %s", val)
+	}
+}
+
+func ptr[T any](val T) *T {
+	return &val
+}
@@ -0,0 +1,281 @@
+package pulse
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// Wraps any error that happened while connecting through a proxy
+type proxyError struct {
+	Proto string
+	Err   error
+}
+
+func (this *proxyError) Error() string {
+	return fmt.Sprintf("%s proxy: %v", this.Proto, this.Err)
+}
+
+func (this *proxyError) Unwrap() error {
+	return this.Err
+}
+
+func isProxyError(err error) bool {
+	var proxyErr *proxyError
+	return errors.As(err, &proxyErr)
+}
+
+func getProxyUrlDialer(urlString string) (proxy.ContextDialer, error) {
+
+	if strings.HasPrefix(urlString, "$") {
+		urlString = os.Getenv(strings.ToUpper(urlString[1:]))
+	}
+
+	if urlString == "" {
+		return nil, errors.New("empty proxy url")
+	}
+
+	proxyUrl, err := url.Parse(urlString)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %v", err)
+	}
+
+	if proxyUrl.Host == "" {
+		return nil, errors.New("proxy host is empty")
+	}
+
+	switch scheme := strings.ToLower(proxyUrl.Scheme); scheme {
+
+	case "socks", "socks5", "socks5h":
+
+		var proxyAuth *proxy.Auth
+		if username := proxyUrl.User.Username(); username != "" {
+			pass, _ := proxyUrl.User.Password()
+			proxyAuth = &proxy.Auth{User: username, Password: pass}
+		}
+
+		dialer, err := proxy.SOCKS5("tcp", proxyUrl.Host, proxyAuth, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+
+		return &socksProxyDialer{
+			dialer:    dialer.(proxy.ContextDialer),
+			remoteDns: scheme == "socks5h",
+		}, nil
+
+	case "http", "https":
+
+		dialer := httpProxyDialer{
+			proxyUrl: *proxyUrl,
+		}
+
+		if proxyUrl.Port() == "" {
+			if scheme == "https" {
+				dialer.proxyUrl.Host = net.JoinHostPort(proxyUrl.Hostname(), "443")
+			} else {
+				dialer.proxyUrl.Host = net.JoinHostPort(proxyUrl.Hostname(), "80")
+			}
+		}
+
+		if username := proxyUrl.User.Username(); username != "" {
+			pass, _ := proxyUrl.User.Password()
+			dialer.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+pass))
+		}
+
+		return &dialer, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol: %v", proxyUrl.Scheme)
+	}
+}
+
+// Checks whether the proxy resolves host names on its side, in which case the address family of the target can't be controlled
+func isRemoteDnsProxy(dialer proxy.ContextDialer) bool {
+	switch dialer := dialer.(type) {
+	case *socksProxyDialer:
+		return dialer.remoteDns
+	case *httpProxyDialer:
+		return true
+	default:
+		return false
+	}
+}
+
+// A connection tunneled through a proxy. The remote address is the target address that was sent to the proxy,
+// which is either an ip address or a host name if the proxy resolves it by itself
+type proxyConn struct {
+	net.Conn
+	target string
+}
+
+func (this *proxyConn) RemoteAddr() net.Addr {
+	return proxyTargetAddr(this.target)
+}
+
+type proxyTargetAddr string
+
+func (this proxyTargetAddr) Network() string {
+	return "tcp"
+}
+
+func (this proxyTargetAddr) String() string {
+	return string(this)
+}
+
+// Dials through a socks5 proxy. Host names are resolved locally unless remoteDns is set (socks5h)
+type socksProxyDialer struct {
+	dialer    proxy.ContextDialer
+	remoteDns bool
+}
+
+func (this *socksProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	if !this.remoteDns {
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if net.ParseIP(host) == nil {
+
+			//	tcp4 and tcp6 networks restrict the address family of the target
+			addrs, err := net.DefaultResolver.LookupIP(ctx, "ip"+strings.TrimPrefix(network, "tcp"), host)
+			if err != nil {
+				return nil, err
+			} else if len(addrs) == 0 {
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+
+			addr = net.JoinHostPort(addrs[0].String(), port)
+		}
+	}
+
+	conn, err := this.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, &proxyError{Proto: "socks", Err: err}
+	}
+
+	return &proxyConn{Conn: conn, target: addr}, nil
+}
+
+// Dials through an http(s) proxy using CONNECT tunnels
+type httpProxyDialer struct {
+	proxyUrl url.URL
+	auth     string
+}
+
+func (this *httpProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	conn, err := this.connect(ctx, network, addr)
+	if err != nil {
+		return nil, &proxyError{Proto: this.proxyUrl.Scheme, Err: err}
+	}
+
+	return &proxyConn{Conn: conn, target: addr}, nil
+}
+
+func (this *httpProxyDialer) connect(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		break
+	default:
+		return nil, fmt.Errorf("network '%s' not supported", network)
+	}
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", this.proxyUrl.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ToLower(this.proxyUrl.Scheme) == "https" {
+
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: this.proxyUrl.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	//	unblock the handshake if the context gets cancelled
+	stopWatch := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if this.auth != "" {
+		req.Header.Set("Proxy-Authorization", this.auth)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	var handshake = func() error {
+
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("connect %s: %s", addr, resp.Status)
+		}
+
+		return nil
+	}
+
+	err = handshake()
+
+	if !stopWatch() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	//	the proxy is not supposed to send anything before the tunnel is used,
+	//	but if it did, the buffered bytes must not be lost
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (this *bufferedConn) Read(buff []byte) (int, error) {
+	return this.reader.Read(buff)
+}
@@ -2,16 +2,45 @@ package pulse
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// Metric descriptions that are sent as HELP lines
+var pushgatewayHelp = map[string]string{
+	"probe_elapsed":      "Time the last probe run took, in milliseconds",
+	"up":                 "Whether the service was up during the last probe run",
+	"http_status":        "HTTP status code returned during the last probe run",
+	"latency":            "Service latency measured by the last probe run, in milliseconds",
+	"tls_version":        "TLS version used during the last probe run",
+	"timing_dns":         "Host name resolution time, in milliseconds",
+	"timing_connect":     "TCP connection setup time, in milliseconds",
+	"timing_tls":         "TLS handshake time, in milliseconds",
+	"timing_ttfb":        "Time to the first response byte, in milliseconds",
+	"timing_transfer":    "Response body transfer time, in milliseconds",
+	"tls_cert_days_left": "Number of full days left until the server certificate expires",
+	"tls_cert_valid":     "Whether the server certificate chain is valid",
+	"icmp_sent":          "Number of echo requests sent",
+	"icmp_received":      "Number of echo replies received",
+	"icmp_loss":          "ICMP packet loss percentage",
+	"icmp_rtt_min":       "Min ICMP round trip time, in milliseconds",
+	"icmp_rtt_avg":       "Average ICMP round trip time, in milliseconds",
+	"icmp_rtt_max":       "Max ICMP round trip time, in milliseconds",
+	"icmp_rtt_stddev":    "ICMP round trip time standard deviation, in milliseconds",
+	"icmp_jitter":        "ICMP round trip time jitter, in milliseconds",
+}
+
 func NewPushgatewayStorage(hostUrl string) (*pushgatewayStorage, error) {
 
 	baseUrl, err := url.Parse(hostUrl)
@@ -32,11 +61,28 @@ func NewPushgatewayStorage(hostUrl string) (*pushgatewayStorage, error) {
 		return nil, fmt.Errorf("unsupported protocol scheme '%s'", baseUrl.Scheme)
 	}
 
-	this := &pushgatewayStorage{hostUrl: url.URL{
-		Scheme: baseUrl.Scheme,
-		Host:   baseUrl.Host,
-		User:   baseUrl.User,
-	}}
+	this := &pushgatewayStorage{
+		hostUrl: url.URL{
+			Scheme: baseUrl.Scheme,
+			Host:   baseUrl.Host,
+		},
+		job: "pulse",
+	}
+
+	if baseUrl.User != nil {
+		pass, _ := baseUrl.User.Password()
+		this.basicAuth = url.UserPassword(baseUrl.User.Username(), pass)
+	}
+
+	params := baseUrl.Query()
+
+	if val := params.Get("job"); val != "" {
+		this.job = val
+	}
+
+	if val := params.Get("instance"); val != "" {
+		this.instance = &val
+	}
 
 	if err := this.Ping(context.Background()); err != nil {
 		return nil, fmt.Errorf("unable to connect: %v", err)
@@ -46,7 +92,10 @@ func NewPushgatewayStorage(hostUrl string) (*pushgatewayStorage, error) {
 }
 
 type pushgatewayStorage struct {
-	hostUrl url.URL
+	hostUrl   url.URL
+	basicAuth *url.Userinfo
+	job       string
+	instance  *string
 }
 
 // Returns client TypeID
@@ -59,81 +108,274 @@ func (this *pushgatewayStorage) Version() string {
 	return "v1"
 }
 
-// Checks if the service is up and running. Returns non-nil error if failed to connect
-func (this *pushgatewayStorage) Ping(ctx context.Context) error {
+func (this *pushgatewayStorage) fetch(ctx context.Context, method string, path string, body io.Reader) (*http.Response, error) {
 
-	pingUrl := this.hostUrl
-	pingUrl.Path = "/api/v1/status"
+	reqUrl := this.hostUrl
+	reqUrl.Path = path
 
-	req, err := http.NewRequest("GET", pingUrl.String(), nil)
+	req, err := http.NewRequest(method, reqUrl.String(), body)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if this.basicAuth != nil {
+		pass, _ := this.basicAuth.Password()
+		req.SetBasicAuth(this.basicAuth.Username(), pass)
 	}
 
 	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+
+		defer resp.Body.Close()
+
+		if body, err := io.ReadAll(resp.Body); err == nil {
+			slog.Debug("PUSHGATEWAY: Request error",
+				slog.String("method", method),
+				slog.String("path", path),
+				slog.String("body", string(body)))
+		}
+
+		return nil, httpStatusError(resp.StatusCode, fmt.Errorf("unexpected status code: %d", resp.StatusCode))
 	}
 
-	return nil
+	return resp, nil
+}
+
+// Checks if the service is up and running. Returns non-nil error if failed to connect
+func (this *pushgatewayStorage) Ping(ctx context.Context) error {
+
+	resp, err := this.fetch(ctx, "GET", "/api/v1/status", nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
 }
 
 // Writes a single uptime metric
 func (this *pushgatewayStorage) WriteUptime(ctx context.Context, entry UptimeEntry) error {
+	return this.push(ctx, this.groupingKey(entry), pushgatewayEntryLiner(entry))
+}
 
-	pushUrl := this.hostUrl
-	pushUrl.Path = "/metrics/job/pulse"
+// Writes multiple uptime metrics. Pushgateway only keeps the last sample of each group,
+// so older entries of the same group are skipped
+func (this *pushgatewayStorage) WriteUptimeBatch(ctx context.Context, entries []UptimeEntry) error {
 
-	var addLabel = func(key, val string) {
-		pushUrl.Path += fmt.Sprintf("/%s/%s", url.PathEscape(key), url.PathEscape(val))
-	}
+	var paths []string
+	groups := map[string]UptimeEntry{}
 
-	addLabel("probe", entry.Label)
-	addLabel("probe_type", entry.ProbeType)
+	for _, entry := range entries {
 
-	var liner pushgatewayLiner
+		path := this.groupingKey(entry).Path()
 
-	liner.WriteDuration("probe_elapsed", entry.ProbeElapsed)
-	liner.WriteBool("up", entry.Up)
-	liner.WriteInt("http_status", int64(entry.FillHttpStatus()))
-	liner.WriteDuration("latency", entry.FillLatency())
-	liner.WriteInt("tls_version", int64(entry.FillTlsVersion()))
+		if prev, has := groups[path]; !has {
+			paths = append(paths, path)
+		} else if entry.Timestamp.Before(prev.Timestamp) {
+			continue
+		}
 
-	if entry.Host != nil {
-		addLabel("host", *entry.Host)
+		groups[path] = entry
 	}
 
-	req, err := http.NewRequest("POST", pushUrl.String(), liner.Reader())
+	for _, path := range paths {
+		entry := groups[path]
+		if err := this.push(ctx, this.groupingKey(entry), pushgatewayEntryLiner(entry)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replaces all of the metrics in the group
+func (this *pushgatewayStorage) push(ctx context.Context, group pushgatewayGroup, liner *pushgatewayLiner) error {
+
+	resp, err := this.fetch(ctx, "PUT", group.Path(), liner.Reader())
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	return resp.Body.Close()
+}
+
+// Returns the labels that identify an entry group. Only the labels that don't change between runs are used,
+// otherwise every change would leave a stale group behind
+func (this *pushgatewayStorage) groupingKey(entry UptimeEntry) pushgatewayGroup {
+
+	group := pushgatewayGroup{
+		Job: this.job,
+		Labels: map[string]string{
+			"probe":      entry.Label,
+			"probe_type": entry.ProbeType,
+		},
+	}
+
+	if this.instance != nil {
+		group.Labels["instance"] = *this.instance
+	}
+
+	//	entries of a dual-stack probe must land in separate groups
+	if entry.IpFamily != nil {
+		group.Labels["ip_family"] = *entry.IpFamily
+	}
+
+	return group
+}
+
+// Deletes the groups that belong to this job and instance, but not to any of the active probes.
+// Groups from the older versions that used the host address as a grouping label are deleted as well
+func (this *pushgatewayStorage) DeleteStaleGroups(ctx context.Context, activeProbes []string) error {
+
+	resp, err := this.fetch(ctx, "GET", "/api/v1/metrics", nil)
 	if err != nil {
 		return err
 	}
-
 	defer resp.Body.Close()
 
-	if resp.StatusCode > 300 {
+	var payload struct {
+		Data []struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"data"`
+	}
 
-		if body, err := io.ReadAll(resp.Body); err == nil {
-			slog.Debug("PUSHGATEWAY: Request error",
-				slog.String("body", string(body)))
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return fmt.Errorf("failed to decode groups list: %v", err)
+	}
+
+	var errs []error
+
+	for _, item := range payload.Data {
+
+		if item.Labels["job"] != this.job {
+			continue
+		}
+
+		instance := item.Labels["instance"]
+		switch {
+		case this.instance == nil && instance != "":
+			continue
+		case this.instance != nil && instance != *this.instance:
+			continue
+		}
+
+		_, hasHost := item.Labels["host"]
+		if !hasHost && slices.Contains(activeProbes, item.Labels["probe"]) {
+			continue
+		}
+
+		group := pushgatewayGroup{Job: this.job, Labels: map[string]string{}}
+		for key, val := range item.Labels {
+			if key != "job" {
+				group.Labels[key] = val
+			}
 		}
 
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		slog.Info("PUSHGATEWAY: Deleting stale group",
+			slog.String("path", group.Path()))
+
+		if err := this.delete(ctx, group.Path()); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+func (this *pushgatewayStorage) delete(ctx context.Context, path string) error {
+
+	resp, err := this.fetch(ctx, "DELETE", path, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+type pushgatewayGroup struct {
+	Job    string
+	Labels map[string]string
+}
+
+// Returns the grouping key url path
+func (this pushgatewayGroup) Path() string {
+
+	var keys []string
+	for key := range this.Labels {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	path := "/metrics" + pushgatewayPathLabel("job", this.Job)
+	for _, key := range keys {
+		path += pushgatewayPathLabel(key, this.Labels[key])
+	}
+
+	return path
+}
+
+// Encodes a grouping label as a path segment. Values that can't be put into the path as is are base64-encoded
+func pushgatewayPathLabel(key, val string) string {
+
+	if val == "" || strings.Contains(val, "/") {
+		return fmt.Sprintf("/%s@base64/%s", key, base64.RawURLEncoding.EncodeToString([]byte(val)))
+	}
+
+	return fmt.Sprintf("/%s/%s", key, url.PathEscape(val))
+}
+
+func pushgatewayEntryLiner(entry UptimeEntry) *pushgatewayLiner {
+
+	liner := pushgatewayLiner{Labels: map[string]string{}}
+
+	//	the values that change between runs are set as metric labels instead of being a part of the grouping key
+	if entry.Host != nil {
+		liner.Labels["host"] = *entry.Host
+	}
+
+	if entry.FailureKind != nil {
+		liner.Labels["failure_kind"] = string(*entry.FailureKind)
+	}
+
+	liner.WriteDuration("probe_elapsed", entry.ProbeElapsed)
+	liner.WriteBool("up", entry.Up)
+	liner.WriteInt("http_status", int64(entry.FillHttpStatus()))
+	liner.WriteDuration("latency", entry.FillLatency())
+	liner.WriteInt("tls_version", int64(entry.FillTlsVersion()))
+
+	timings := entry.FillHttpTimings()
+	liner.WriteDuration("timing_dns", timings.Dns)
+	liner.WriteDuration("timing_connect", timings.Connect)
+	liner.WriteDuration("timing_tls", timings.Tls)
+	liner.WriteDuration("timing_ttfb", timings.Ttfb)
+	liner.WriteDuration("timing_transfer", timings.Transfer)
+
+	if entry.TlsCert != nil {
+		liner.WriteInt("tls_cert_days_left", int64(entry.TlsCert.DaysLeft))
+		liner.WriteBool("tls_cert_valid", entry.TlsCert.Valid)
+	}
+
+	if entry.IcmpStats != nil {
+		liner.WriteInt("icmp_sent", int64(entry.IcmpStats.Sent))
+		liner.WriteInt("icmp_received", int64(entry.IcmpStats.Received))
+		liner.WriteFloat("icmp_loss", entry.IcmpStats.Loss)
+		liner.WriteFloat("icmp_rtt_min", durationMillis(entry.IcmpStats.MinRtt))
+		liner.WriteFloat("icmp_rtt_avg", durationMillis(entry.IcmpStats.AvgRtt))
+		liner.WriteFloat("icmp_rtt_max", durationMillis(entry.IcmpStats.MaxRtt))
+		liner.WriteFloat("icmp_rtt_stddev", durationMillis(entry.IcmpStats.StdDevRtt))
+		liner.WriteFloat("icmp_jitter", durationMillis(entry.IcmpStats.Jitter))
+	}
+
+	return &liner
 }
 
 type pushgatewayLiner struct {
+	Labels map[string]string
+
 	builder strings.Builder
 }
 
@@ -142,13 +384,37 @@ func (this *pushgatewayLiner) Reader() io.Reader {
 }
 
 func (this *pushgatewayLiner) addLine(key, val string) {
-	this.builder.WriteString(fmt.Sprintf("%s %s\n", key, val))
+
+	if help, has := pushgatewayHelp[key]; has {
+		this.builder.WriteString(fmt.Sprintf("# HELP %s %s\n", key, help))
+	}
+
+	//	every pushed value is a snapshot of the last probe run
+	this.builder.WriteString(fmt.Sprintf("# TYPE %s gauge\n", key))
+
+	if len(this.Labels) == 0 {
+		this.builder.WriteString(fmt.Sprintf("%s %s\n", key, val))
+		return
+	}
+
+	var labels []string
+	for key, val := range this.Labels {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", key, pushgatewayEscapeLabel(val)))
+	}
+
+	sort.Strings(labels)
+
+	this.builder.WriteString(fmt.Sprintf("%s{%s} %s\n", key, strings.Join(labels, ","), val))
 }
 
 func (this *pushgatewayLiner) WriteInt(key string, val int64) {
 	this.addLine(key, strconv.FormatInt(val, 10))
 }
 
+func (this *pushgatewayLiner) WriteFloat(key string, val float64) {
+	this.addLine(key, strconv.FormatFloat(val, 'f', -1, 64))
+}
+
 func (this *pushgatewayLiner) WriteDuration(key string, val time.Duration) {
 	this.WriteInt(key, val.Milliseconds())
 }
@@ -160,3 +426,8 @@ func (this *pushgatewayLiner) WriteBool(key string, val bool) {
 		this.WriteInt(key, 0)
 	}
 }
+
+// Escapes a label value according to the prometheus text format
+func pushgatewayEscapeLabel(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val)
+}
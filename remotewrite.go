@@ -0,0 +1,516 @@
+package pulse
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+type RemoteWriteOptions struct {
+	//	Bearer token sent in the Authorization header. Basic auth credentials are taken from the url instead
+	BearerToken string
+	//	Value of the 'job' label (defaults to "pulse")
+	Job string
+	//	Value of the 'instance' label. The label is omitted when empty
+	Instance string
+	//	Max number of samples sent in a single request (defaults to 2000)
+	MaxSamplesPerSend int
+	//	Max time the samples can wait in the queue before being sent (defaults to 5s)
+	FlushInterval time.Duration
+	//	Max number of samples kept in the queue while the endpoint is unavailable (defaults to 100000). The oldest ones are dropped first
+	MaxPendingSamples int
+	//	Number of retries after a transient error (defaults to 3, negative values disable retries)
+	MaxRetries int
+	//	Initial retry delay (defaults to 1s)
+	MinBackoff time.Duration
+	//	Max retry delay (defaults to 30s)
+	MaxBackoff time.Duration
+}
+
+// Creates a writer that pushes samples to a prometheus-compatible TSDB (prometheus, mimir, victoriametrics, thanos etc)
+// using the remote write protocol
+func NewRemoteWriteStorage(endpoint string, opts RemoteWriteOptions) (*remoteWriteStorage, error) {
+
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpointUrl.Host == "" {
+		return nil, fmt.Errorf("missing url host")
+	}
+
+	switch endpointUrl.Scheme {
+	case "":
+		endpointUrl.Scheme = "http"
+	case "http", "https":
+		break
+	default:
+		return nil, fmt.Errorf("unsupported protocol scheme '%s'", endpointUrl.Scheme)
+	}
+
+	if opts.Job == "" {
+		opts.Job = "pulse"
+	}
+
+	if opts.MaxSamplesPerSend <= 0 {
+		opts.MaxSamplesPerSend = 2000
+	}
+
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+
+	if opts.MaxPendingSamples < opts.MaxSamplesPerSend {
+		opts.MaxPendingSamples = max(100_000, opts.MaxSamplesPerSend)
+	}
+
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	} else if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(30*time.Second, opts.MinBackoff)
+	}
+
+	this := &remoteWriteStorage{
+		opts:     opts,
+		failures: map[string]FailureKind{},
+		flush:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	if endpointUrl.User != nil {
+		pass, _ := endpointUrl.User.Password()
+		this.basicAuth = url.UserPassword(endpointUrl.User.Username(), pass)
+		endpointUrl.User = nil
+	}
+
+	this.endpoint = *endpointUrl
+
+	this.wg.Add(1)
+	go this.run()
+
+	return this, nil
+}
+
+type remoteWriteStorage struct {
+	endpoint  url.URL
+	basicAuth *url.Userinfo
+	opts      RemoteWriteOptions
+
+	mtx   sync.Mutex
+	queue []remoteWriteSeries
+	//	last failure kind of every series that is currently down
+	failures map[string]FailureKind
+
+	flush chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Returns client TypeID
+func (this *remoteWriteStorage) Type() string {
+	return "remote_write"
+}
+
+// Returns client version
+func (this *remoteWriteStorage) Version() string {
+	return "v1"
+}
+
+// Queues a single uptime metric
+func (this *remoteWriteStorage) WriteUptime(ctx context.Context, entry UptimeEntry) error {
+	return this.WriteUptimeBatch(ctx, []UptimeEntry{entry})
+}
+
+// Queues multiple uptime metrics. The samples are sent in batches of up to MaxSamplesPerSend samples,
+// once a batch is full or the flush interval passes
+func (this *remoteWriteStorage) WriteUptimeBatch(ctx context.Context, entries []UptimeEntry) error {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	for _, entry := range entries {
+		this.queue = append(this.queue, this.entrySeries(entry)...)
+	}
+
+	this.trimQueue()
+
+	if len(this.queue) >= this.opts.MaxSamplesPerSend {
+		select {
+		case this.flush <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Stops the flush loop and sends the remaining samples
+func (this *remoteWriteStorage) Close() error {
+
+	close(this.done)
+	this.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return this.Flush(ctx)
+}
+
+// Sends all of the queued samples. Samples that failed with a transient error are put back into the queue
+func (this *remoteWriteStorage) Flush(ctx context.Context) error {
+
+	for {
+
+		this.mtx.Lock()
+
+		//	samples of every series must be sent in timestamp order, otherwise they're rejected as out of order
+		sort.SliceStable(this.queue, func(i, j int) bool {
+			return this.queue[i].Timestamp < this.queue[j].Timestamp
+		})
+
+		batch := this.queue[:min(len(this.queue), this.opts.MaxSamplesPerSend)]
+		this.queue = this.queue[len(batch):]
+
+		this.mtx.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := this.send(ctx, &remoteWriteRequest{series: batch})
+		if err == nil {
+			continue
+		}
+
+		if !IsTransientError(err) {
+			slog.Error("REMOTE WRITE: Samples rejected by the endpoint, dropping",
+				slog.Int("count", len(batch)),
+				slog.String("err", err.Error()))
+			continue
+		}
+
+		this.mtx.Lock()
+		this.queue = slices.Concat(batch, this.queue)
+		this.trimQueue()
+		this.mtx.Unlock()
+
+		return err
+	}
+}
+
+// Drops the oldest samples that don't fit into the queue. Must be called with the lock held
+func (this *remoteWriteStorage) trimQueue() {
+
+	dropped := len(this.queue) - this.opts.MaxPendingSamples
+	if dropped <= 0 {
+		return
+	}
+
+	sort.SliceStable(this.queue, func(i, j int) bool {
+		return this.queue[i].Timestamp < this.queue[j].Timestamp
+	})
+
+	this.queue = append([]remoteWriteSeries(nil), this.queue[dropped:]...)
+
+	slog.Warn("REMOTE WRITE: Queue is full, dropping the oldest samples",
+		slog.Int("count", dropped))
+}
+
+func (this *remoteWriteStorage) run() {
+
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(this.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+		case <-this.done:
+			return
+		case <-ticker.C:
+		case <-this.flush:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := this.Flush(ctx)
+		cancel()
+
+		if err != nil {
+			slog.Warn("REMOTE WRITE: Flush failed, keeping the samples queued",
+				slog.String("err", err.Error()))
+		}
+	}
+}
+
+// Converts an entry into single-sample series. Must be called with the lock held
+func (this *remoteWriteStorage) entrySeries(entry UptimeEntry) []remoteWriteSeries {
+
+	//	host addresses aren't a part of the series for the same reason as with the exporter
+	labels := map[string]string{
+		"job":        this.opts.Job,
+		"probe":      entry.Label,
+		"probe_type": entry.ProbeType,
+	}
+
+	if this.opts.Instance != "" {
+		labels["instance"] = this.opts.Instance
+	}
+
+	if entry.IpFamily != nil {
+		labels["ip_family"] = *entry.IpFamily
+	}
+
+	timestamp := entry.Timestamp.UnixMilli()
+
+	var series []remoteWriteSeries
+
+	//	the same gauges as served by the exporter, so that the queries work with both
+	for _, gauge := range exporterGauges {
+
+		val, has := gauge.Value(entry)
+		if !has {
+			continue
+		}
+
+		series = append(series, remoteWriteSeries{
+			Labels:    exporterWithLabel(labels, "__name__", gauge.Name),
+			Value:     val,
+			Timestamp: timestamp,
+		})
+	}
+
+	var failureSeries = func(kind FailureKind, val float64) remoteWriteSeries {
+		labels := exporterWithLabel(labels, "failure_kind", string(kind))
+		return remoteWriteSeries{
+			Labels:    exporterWithLabel(labels, "__name__", remoteWriteFailureMetric),
+			Value:     val,
+			Timestamp: timestamp,
+		}
+	}
+
+	key := exporterLabelString(labels)
+
+	//	there's no scrape that would mark the series as stale, so the previous failure has to be reset explicitly
+	if prev, has := this.failures[key]; has && (entry.FailureKind == nil || *entry.FailureKind != prev) {
+		series = append(series, failureSeries(prev, 0))
+		delete(this.failures, key)
+	}
+
+	if entry.FailureKind != nil {
+		series = append(series, failureSeries(*entry.FailureKind, 1))
+		this.failures[key] = *entry.FailureKind
+	}
+
+	return series
+}
+
+func (this *remoteWriteStorage) send(ctx context.Context, request *remoteWriteRequest) error {
+
+	body := snappy.Encode(nil, request.Marshal())
+
+	backoff := this.opts.MinBackoff
+
+	for attempt := 0; ; attempt++ {
+
+		retryAfter, err := this.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+
+		if !IsTransientError(err) || ctx.Err() != nil || attempt >= this.opts.MaxRetries {
+			return err
+		}
+
+		delay := backoff
+		if retryAfter > 0 {
+			delay = min(retryAfter, this.opts.MaxBackoff)
+		}
+
+		slog.Debug("REMOTE WRITE: Retrying request",
+			slog.String("err", err.Error()),
+			slog.Duration("retry_in", delay))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+
+		backoff = min(backoff*2, this.opts.MaxBackoff)
+	}
+}
+
+// Sends a single request. Returns the Retry-After delay, if the server has set one
+func (this *remoteWriteStorage) post(ctx context.Context, body []byte) (time.Duration, error) {
+
+	req, err := http.NewRequest("POST", this.endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "pulse")
+
+	if this.opts.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+this.opts.BearerToken)
+	} else if this.basicAuth != nil {
+		pass, _ := this.basicAuth.Password()
+		req.SetBasicAuth(this.basicAuth.Username(), pass)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return 0, nil
+	}
+
+	if body, err := io.ReadAll(io.LimitReader(resp.Body, 4096)); err == nil {
+		slog.Debug("REMOTE WRITE: Request error",
+			slog.Int("status", resp.StatusCode),
+			slog.String("body", string(body)))
+	}
+
+	//	other 4xx errors mean that the data was rejected, so sending it again won't help
+	err = httpStatusError(resp.StatusCode, fmt.Errorf("unexpected status code: %d", resp.StatusCode))
+
+	var retryAfter time.Duration
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+
+	return retryAfter, err
+}
+
+// Metric that is set for every failed probe run, labeled with the failure kind
+const remoteWriteFailureMetric = "pulse_probe_failure"
+
+type remoteWriteSeries struct {
+	Labels    map[string]string
+	Value     float64
+	Timestamp int64
+}
+
+// Protobuf-encoded prometheus.WriteRequest, as defined in prometheus/prompb/remote.proto.
+// The message is simple enough to be encoded by hand instead of depending on the protobuf runtime
+type remoteWriteRequest struct {
+	series []remoteWriteSeries
+}
+
+func (this *remoteWriteRequest) Append(series remoteWriteSeries) {
+	this.series = append(this.series, series)
+}
+
+func (this *remoteWriteRequest) Marshal() []byte {
+
+	var buff []byte
+
+	//	every series here has a single sample, so there's no need to merge them
+	for _, series := range this.series {
+
+		var names []string
+		for name := range series.Labels {
+			names = append(names, name)
+		}
+
+		//	receivers expect labels sorted by name
+		sort.Strings(names)
+
+		var timeseries []byte
+
+		for _, name := range names {
+			var label []byte
+			label = protoAppendString(label, 1, name)
+			label = protoAppendString(label, 2, series.Labels[name])
+			timeseries = protoAppendBytes(timeseries, 1, label)
+		}
+
+		var sample []byte
+		sample = protoAppendDouble(sample, 1, series.Value)
+		sample = protoAppendVarint(sample, 2, uint64(series.Timestamp))
+		timeseries = protoAppendBytes(timeseries, 2, sample)
+
+		buff = protoAppendBytes(buff, 1, timeseries)
+	}
+
+	return buff
+}
+
+const (
+	protoWireVarint = 0
+	protoWireI64    = 1
+	protoWireLen    = 2
+)
+
+func protoAppendTag(buff []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(buff, uint64(field)<<3|uint64(wireType))
+}
+
+// Scalar fields with default values are omitted, same as the reference proto3 encoder does
+
+func protoAppendVarint(buff []byte, field int, val uint64) []byte {
+
+	if val == 0 {
+		return buff
+	}
+
+	buff = protoAppendTag(buff, field, protoWireVarint)
+	return binary.AppendUvarint(buff, val)
+}
+
+func protoAppendDouble(buff []byte, field int, val float64) []byte {
+
+	if val == 0 {
+		return buff
+	}
+
+	buff = protoAppendTag(buff, field, protoWireI64)
+	return binary.LittleEndian.AppendUint64(buff, math.Float64bits(val))
+}
+
+func protoAppendBytes(buff []byte, field int, val []byte) []byte {
+	buff = protoAppendTag(buff, field, protoWireLen)
+	buff = binary.AppendUvarint(buff, uint64(len(val)))
+	return append(buff, val...)
+}
+
+func protoAppendString(buff []byte, field int, val string) []byte {
+
+	if val == "" {
+		return buff
+	}
+
+	buff = protoAppendTag(buff, field, protoWireLen)
+	buff = binary.AppendUvarint(buff, uint64(len(val)))
+	return append(buff, val...)
+}
@@ -0,0 +1,38 @@
+package pulse
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"testing"
+)
+
+func TestRemoteWriteRequestMarshal(t *testing.T) {
+
+	var request remoteWriteRequest
+
+	request.Append(remoteWriteSeries{
+		Labels:    map[string]string{"probe": "example", "__name__": "pulse_up", "job": "pulse"},
+		Value:     1,
+		Timestamp: 1700000000123,
+	})
+
+	request.Append(remoteWriteSeries{
+		Labels:    map[string]string{"__name__": "pulse_probe_duration_seconds", "probe": "example"},
+		Value:     0.25,
+		Timestamp: -1,
+	})
+
+	request.Append(remoteWriteSeries{
+		Labels:    map[string]string{"__name__": "x"},
+		Value:     math.Inf(-1),
+		Timestamp: 0,
+	})
+
+	//	the same request encoded with prometheus/prompb (v0.54.1) WriteRequest.Marshal()
+	expected, _ := hex.DecodeString("0a480a140a085f5f6e616d655f5f120870756c73655f75700a0c0a036a6f62120570756c73650a100a0570726f626512076578616d706c65121009000000000000f03f10fbd095ffbc310a520a280a085f5f6e616d655f5f121c70756c73655f70726f62655f6475726174696f6e5f7365636f6e64730a100a0570726f626512076578616d706c65121409000000000000d03f10ffffffffffffffffff010a1a0a0d0a085f5f6e616d655f5f120178120909000000000000f0ff")
+
+	if result := request.Marshal(); !bytes.Equal(result, expected) {
+		t.Errorf("unexpected encoding:\n got: %x\nwant: %x", result, expected)
+	}
+}
@@ -0,0 +1,309 @@
+package pulse
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Max number of bind parameters sqlite allows in a single statement
+const sqliteMaxBindvars = 32766
+
+// Timestamp format used for the time columns. Timestamps are stored in UTC with a fixed width,
+// so that they can be compared as strings and passed to the sqlite date functions as is
+const sqliteTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// How often the rows past the retention period are deleted
+const sqlitePruneInterval = time.Hour
+
+// Schema migrations, tracked with the user_version pragma. Same rules as with the timescale migrations apply
+var sqliteMigrations = []schemaMigration{
+	{
+		Name: "create_uptime_table",
+		Statements: []string{
+			`create table if not exists pulse_uptime (
+				time text not null,
+				label text not null,
+				probe_elapsed integer not null,
+				probe_type text not null,
+				up integer not null,
+				latency integer,
+				host text,
+				http_status integer,
+				tls_version integer,
+				timing_dns integer,
+				timing_connect integer,
+				timing_tls integer,
+				timing_ttfb integer,
+				timing_transfer integer,
+				tls_cert_subject text,
+				tls_cert_issuer text,
+				tls_cert_expires text,
+				tls_cert_valid integer,
+				error text,
+				failure_kind text,
+				icmp_sent integer,
+				icmp_received integer,
+				icmp_loss real,
+				icmp_rtt_min real,
+				icmp_rtt_avg real,
+				icmp_rtt_max real,
+				icmp_rtt_stddev real,
+				icmp_jitter real,
+				ip_family text
+			)`,
+			`create index if not exists pulse_uptime_label_time_idx on pulse_uptime (label, time desc)`,
+			`create index if not exists pulse_uptime_time_idx on pulse_uptime (time desc)`,
+		},
+	},
+}
+
+type SqliteOptions struct {
+	//	Rows older than that are deleted. Data is kept forever when not set
+	Retention time.Duration
+}
+
+// Creates a writer that stores entries in a local sqlite database file
+func NewSqliteStorage(path string, opts SqliteOptions) (*sqliteStorage, error) {
+
+	if path == "" {
+		return nil, errors.New("database path is empty")
+	}
+
+	if opts.Retention < 0 {
+		return nil, errors.New("retention can't be negative")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	//	wal lets other processes read the database while pulse is writing to it
+	params := url.Values{}
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous(NORMAL)")
+	params.Add("_pragma", "busy_timeout(5000)")
+
+	//	the path is a part of a file uri, so the characters that have a special meaning there have to be escaped
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?" + params.Encode()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	//	sqlite only supports a single writer at a time anyway
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	version, err := sqliteMigrate(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	this := &sqliteStorage{
+		db:      db,
+		version: version,
+		table:   "pulse_uptime",
+		done:    make(chan struct{}),
+	}
+
+	if opts.Retention > 0 {
+		this.wg.Add(1)
+		go this.pruneLoop(opts.Retention)
+	}
+
+	return this, nil
+}
+
+type sqliteStorage struct {
+	db      *sql.DB
+	version int
+	table   string
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Returns client TypeID
+func (this *sqliteStorage) Type() string {
+	return "sqlite"
+}
+
+// Returns schema migration version
+func (this *sqliteStorage) Version() string {
+	return strconv.Itoa(this.version)
+}
+
+// Batches are inserted in a single transaction
+func (this *sqliteStorage) AtomicBatches() bool {
+	return true
+}
+
+// Closes the database
+func (this *sqliteStorage) Close() error {
+	close(this.done)
+	this.wg.Wait()
+	return this.db.Close()
+}
+
+// Writes a single uptime metric
+func (this *sqliteStorage) WriteUptime(ctx context.Context, entry UptimeEntry) error {
+
+	row, err := sqliteRow(entry)
+	if err != nil {
+		return err
+	}
+
+	return sqliteError(sqlInsertContext(ctx, this.db, this.table, row))
+}
+
+// Writes multiple uptime metrics in a single transaction
+func (this *sqliteStorage) WriteUptimeBatch(ctx context.Context, entries []UptimeEntry) error {
+
+	var rows []map[string]any
+
+	for _, entry := range entries {
+
+		row, err := sqliteRow(entry)
+		if err != nil {
+			return err
+		}
+
+		rows = append(rows, row)
+	}
+
+	return sqliteError(sqlInsertBatchContext(ctx, this.db, this.table, rows, sqliteMaxBindvars))
+}
+
+// Marks lock contention and disk errors as transient
+func sqliteError(err error) error {
+
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+
+	//	extended result codes keep the primary code in the lower byte
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_FULL, sqlite3.SQLITE_IOERR:
+		return &TransientError{Err: err}
+	}
+
+	return err
+}
+
+// Same as the timescale row, but with the timestamps formatted as text
+func sqliteRow(entry UptimeEntry) (map[string]any, error) {
+
+	row, err := timescaleRow(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, col := range []string{"time", "tls_cert_expires"} {
+		if val, ok := row[col].(time.Time); ok {
+			row[col] = val.UTC().Format(sqliteTimeFormat)
+		}
+	}
+
+	return row, nil
+}
+
+// Applies pending migrations and returns the current schema version
+func sqliteMigrate(ctx context.Context, db *sql.DB) (int, error) {
+
+	var version int
+	if err := db.QueryRowContext(ctx, "pragma user_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %v", err)
+	}
+
+	if version > len(sqliteMigrations) {
+		return version, fmt.Errorf("database schema version %d is newer than the supported %d", version, len(sqliteMigrations))
+	}
+
+	for idx := version; idx < len(sqliteMigrations); idx++ {
+
+		migration := sqliteMigrations[idx]
+		id := idx + 1
+
+		slog.Info("SQLITE: Applying migration",
+			slog.Int("id", id),
+			slog.String("name", migration.Name))
+
+		if err := sqliteApplyMigration(ctx, db, id, migration); err != nil {
+			return version, fmt.Errorf("migration %d (%s): %v", id, migration.Name, err)
+		}
+
+		version = id
+	}
+
+	return version, nil
+}
+
+func sqliteApplyMigration(ctx context.Context, db *sql.DB, id int, migration schemaMigration) error {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range migration.Statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	//	pragmas don't support bind parameters
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("pragma user_version = %d", id)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Deletes rows that are older than the retention period
+func (this *sqliteStorage) pruneLoop(retention time.Duration) {
+
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(sqlitePruneInterval)
+	defer ticker.Stop()
+
+	for {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		query := fmt.Sprintf("delete from %s where time < $1", this.table)
+		result, err := this.db.ExecContext(ctx, query, time.Now().Add(-retention).UTC().Format(sqliteTimeFormat))
+		cancel()
+
+		if err != nil {
+			slog.Error("SQLITE: Failed to delete old rows",
+				slog.String("err", err.Error()))
+		} else if deleted, _ := result.RowsAffected(); deleted > 0 {
+			slog.Debug("SQLITE: Deleted old rows",
+				slog.Int64("count", deleted))
+		}
+
+		select {
+		case <-this.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
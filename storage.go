@@ -2,6 +2,11 @@ package pulse
 
 import (
 	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"net/http"
 	"time"
 )
 
@@ -14,6 +19,92 @@ type StorageWriter interface {
 	WriteUptime(ctx context.Context, entry UptimeEntry) error
 }
 
+// An optional StorageWriter extension for drivers that can write multiple entries in a single request
+type BatchStorageWriter interface {
+	StorageWriter
+	//	Write multiple uptime metrics at once
+	WriteUptimeBatch(ctx context.Context, entries []UptimeEntry) error
+}
+
+// An optional BatchStorageWriter extension for drivers that can retry a failed batch as a whole
+// without duplicating the entries that have made it to the backend
+type AtomicBatchWriter interface {
+	BatchStorageWriter
+	//	Reports whether batches are written all at once, or the backend overwrites the entries that are written again
+	AtomicBatches() bool
+}
+
+func isAtomicBatchWriter(writer StorageWriter) bool {
+	batcher, ok := writer.(AtomicBatchWriter)
+	return ok && batcher.AtomicBatches()
+}
+
+// Writes a batch of entries using the batch method when the writer supports it,
+// falling back to writing them one by one otherwise
+func WriteUptimeBatch(ctx context.Context, writer StorageWriter, entries []UptimeEntry) error {
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if batcher, ok := writer.(BatchStorageWriter); ok {
+		return batcher.WriteUptimeBatch(ctx, entries)
+	}
+
+	for _, entry := range entries {
+		if err := writer.WriteUptime(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Wraps a write error that may go away by itself, like an overloaded or restarting server
+type TransientError struct {
+	Err error
+}
+
+func (this *TransientError) Error() string {
+	return this.Err.Error()
+}
+
+func (this *TransientError) Unwrap() error {
+	return this.Err
+}
+
+// Marks errors caused by the http status codes that are worth retrying (5xx and 429) as transient
+func httpStatusError(status int, err error) error {
+	if status >= 500 || status == http.StatusTooManyRequests {
+		return &TransientError{Err: err}
+	}
+	return err
+}
+
+// Checks whether a write that failed with the error is worth retrying later.
+// Network failures and timeouts are transient, while anything else means that the data was rejected
+func IsTransientError(err error) bool {
+
+	var transient *TransientError
+	if errors.As(err, &transient) {
+		return true
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Versioned schema change of an sql storage backend. Migrations are applied in order, each one in its own transaction
+type schemaMigration struct {
+	Name string
+	//	Statements to execute; every statement must be safe to run against a partially migrated schema
+	Statements []string
+}
+
 type UptimeEntry struct {
 	//	Unique metric label
 	Label string
@@ -33,6 +124,76 @@ type UptimeEntry struct {
 	TlsVersion *int
 	//	Resolved host address
 	Host *string
+	//	Address family that was used (ip4|ip6, only when the probe is restricted to a specific family)
+	IpFamily *string
+	//	Request phase timings (only for http, when a response was received)
+	HttpTimings *HttpTimings
+	//	Server certificate details (only for https)
+	TlsCert *TlsCertInfo
+	//	Packet loss and rtt statistics (only for icmp)
+	IcmpStats *IcmpStats
+	//	Error message describing why the service is down (only if is down)
+	Error *string
+	//	Failure classification (only if is down)
+	FailureKind *FailureKind
+}
+
+type HttpTimings struct {
+	//	Host name resolution time
+	Dns time.Duration
+	//	TCP connection setup time
+	Connect time.Duration
+	//	TLS handshake time
+	Tls time.Duration
+	//	Time between sending the request and receiving the first response byte
+	Ttfb time.Duration
+	//	Response body transfer time
+	Transfer time.Duration
+}
+
+type IcmpStats struct {
+	//	Number of echo requests sent
+	Sent int
+	//	Number of echo replies received
+	Received int
+	//	Packet loss percentage
+	Loss float64
+	//	Min round trip time
+	MinRtt time.Duration
+	//	Average round trip time
+	AvgRtt time.Duration
+	//	Max round trip time
+	MaxRtt time.Duration
+	//	Round trip time standard deviation
+	StdDevRtt time.Duration
+	//	Mean difference between consecutive round trip times
+	Jitter time.Duration
+}
+
+type TlsCertInfo struct {
+	//	Leaf certificate subject
+	Subject string
+	//	Leaf certificate issuer
+	Issuer string
+	//	Subject alternative names
+	DnsNames []string
+	//	Certificate expiration date
+	NotAfter time.Time
+	//	Number of full days left until the certificate expires (negative once it has expired)
+	DaysLeft int
+	//	Whether the chain validates against system roots and matches the host name
+	Valid bool
+}
+
+func (this *UptimeEntry) setFailure(kind FailureKind, err error) {
+
+	this.Up = false
+	this.FailureKind = &kind
+
+	if err != nil {
+		message := err.Error()
+		this.Error = &message
+	}
 }
 
 // Fills Latency for derivers that can't handle null values
@@ -64,3 +225,18 @@ func (this UptimeEntry) FillTlsVersion() int {
 
 	return 0
 }
+
+// Fills HttpTimings for derivers that can't handle null values
+func (this UptimeEntry) FillHttpTimings() HttpTimings {
+
+	if this.HttpTimings != nil {
+		return *this.HttpTimings
+	}
+
+	return HttpTimings{}
+}
+
+// Converts a duration to fractional milliseconds, for the cases when integer precision is not enough
+func durationMillis(val time.Duration) float64 {
+	return float64(val) / float64(time.Millisecond)
+}
@@ -0,0 +1,234 @@
+package pulse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Max number of bytes to read while waiting for the expected banner
+const tcpMaxBannerSize = 4096
+
+type TcpProbe struct {
+	TcpProbeOptions
+
+	Label  string
+	Writer StorageWriter
+
+	locked   atomic.Bool
+	nextExec time.Time
+}
+
+type TcpProbeOptions struct {
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	Timeout  time.Duration `yaml:"timeout" json:"timeout"`
+	Host     string        `yaml:"host" json:"host"`
+	Retries  int           `yaml:"retries" json:"retries"`
+	Send     string        `yaml:"send" json:"send"`
+	Expect   string        `yaml:"expect" json:"expect"`
+	IpFamily string        `yaml:"ip_family" json:"ip_family"`
+}
+
+func (this *TcpProbe) ID() string {
+	return this.Label
+}
+
+func (this *TcpProbe) Type() string {
+	return "tcp"
+}
+
+func (this *TcpProbe) validateConfig() error {
+
+	switch {
+	case this.Label == "":
+		return errors.New("label is empty")
+	case this.Host == "":
+		return errors.New("empty host")
+	}
+
+	if _, _, err := net.SplitHostPort(this.Host); err != nil {
+		return fmt.Errorf("host: %v", err)
+	}
+
+	if this.Interval <= time.Second {
+		this.Interval = time.Minute
+	}
+
+	family, err := validateIpFamily(this.IpFamily)
+	if err != nil {
+		return err
+	}
+
+	this.IpFamily = family
+
+	return nil
+}
+
+func (this *TcpProbe) Ready() (bool, error) {
+
+	if err := this.validateConfig(); err != nil {
+		return false, err
+	}
+
+	if this.Writer == nil {
+		return false, errors.New("writer is nil")
+	}
+
+	//	check locks
+	if this.locked.Load() {
+		return false, nil
+	}
+
+	if this.nextExec.IsZero() || this.nextExec.Before(time.Now()) {
+		this.nextExec = time.Now().Add(this.Interval)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (this *TcpProbe) Exec(ctx context.Context) error {
+
+	if _, err := this.Ready(); err != nil {
+		return err
+	}
+
+	if !this.locked.CompareAndSwap(false, true) {
+		return errors.New("task locked")
+	}
+	defer this.locked.Store(false)
+
+	return execIpFamilies(this.IpFamily, func(family string) error {
+		return this.execFamily(ctx, family)
+	})
+}
+
+func (this *TcpProbe) execFamily(ctx context.Context, family string) error {
+
+	timeout := 10 * time.Second
+	if this.TcpProbeOptions.Timeout > 0 {
+		timeout = this.TcpProbeOptions.Timeout
+	}
+
+	type connStatus struct {
+		RemoteAddr net.IP
+		Latency    time.Duration
+		Err        error
+		ExpectErr  error
+	}
+
+	var fetchStatus = func(ctx context.Context) *connStatus {
+
+		var dialer net.Dialer
+
+		started := time.Now()
+
+		conn, err := dialer.DialContext(ctx, ipFamilyNetwork("tcp", family), this.Host)
+		if err != nil {
+			return &connStatus{Err: err}
+		}
+		defer conn.Close()
+
+		status := connStatus{Latency: time.Since(started)}
+
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			status.RemoteAddr = addr.IP
+		}
+
+		if this.Send == "" && this.Expect == "" {
+			return &status
+		}
+
+		if deadline, has := ctx.Deadline(); has {
+			conn.SetDeadline(deadline)
+		}
+
+		if this.Send != "" {
+			if _, err := conn.Write([]byte(this.Send)); err != nil {
+				status.Err = err
+				return &status
+			}
+		}
+
+		if this.Expect != "" {
+			status.ExpectErr = this.readBanner(conn)
+		}
+
+		return &status
+	}
+
+	dialCtx, cancelDial := context.WithTimeout(ctx, timeout)
+	defer cancelDial()
+
+	started := time.Now()
+
+	status := fetchStatus(dialCtx)
+
+	if status.Err != nil && this.TcpProbeOptions.Retries > 0 {
+		for n := 0; n < this.TcpProbeOptions.Retries && dialCtx.Err() == nil; n++ {
+			if status = fetchStatus(dialCtx); status.Err == nil {
+				break
+			}
+		}
+	}
+
+	entry := UptimeEntry{
+		Label:        this.Label,
+		Timestamp:    time.Now(),
+		ProbeType:    this.Type(),
+		ProbeElapsed: time.Since(started),
+		IpFamily:     ipFamilyTag(family),
+	}
+
+	if status.RemoteAddr != nil {
+		host := status.RemoteAddr.String()
+		entry.Host = &host
+	}
+
+	switch {
+
+	case status.Err != nil:
+		entry.setFailure(classifyError(status.Err), status.Err)
+
+	case status.ExpectErr != nil:
+		entry.setFailure(FailureAssertion, status.ExpectErr)
+
+	default:
+		entry.Up = true
+		entry.Latency = &status.Latency
+	}
+
+	if err := this.Writer.WriteUptime(ctx, entry); err != nil {
+		return fmt.Errorf("storage.WriteUptime: %v", err)
+	}
+
+	return nil
+}
+
+// Reads from the connection until the expected string shows up
+func (this *TcpProbe) readBanner(conn net.Conn) error {
+
+	expect := []byte(this.Expect)
+	var received []byte
+	buff := make([]byte, 512)
+
+	for len(received) < tcpMaxBannerSize {
+
+		n, err := conn.Read(buff)
+		received = append(received, buff[:n]...)
+
+		if bytes.Contains(received, expect) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("expected banner '%s' not received: %v", this.Expect, err)
+		}
+	}
+
+	return fmt.Errorf("expected banner '%s' not received", this.Expect)
+}
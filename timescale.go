@@ -5,80 +5,124 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log/slog"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-func NewTimescaleStorage(dbUrl string) (*timescaleStorage, error) {
+func NewTimescaleStorage(dbUrl string, opts TimescaleOptions) (*timescaleStorage, error) {
 
-	const version = "v2"
+	const tableName = "pulse_uptime"
 
 	db, err := sql.Open("postgres", dbUrl)
 	if err != nil {
 		return nil, err
 	}
 
-	tableName := "pulse_uptime_" + version
+	//	legacy data import can take a while on big tables
+	setupTimeout := time.Minute
+	if opts.ImportLegacy {
+		setupTimeout = time.Hour
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
 	defer cancel()
 
-	var tableExists = func() (bool, error) {
+	var version int
+	var isHypertable bool
+	var rollupTables []timescaleRollupTable
+
+	err = timescaleWithLock(ctx, db, func(conn *sql.Conn) error {
 
-		query := fmt.Sprintf("select exists (select 1 from %s)", tableName)
+		var err error
 
-		_, err := db.QueryContext(ctx, query)
-		if err == nil || strings.Contains(err.Error(), "does not exist") {
-			return err == nil, nil
+		if version, err = timescaleMigrate(ctx, conn); err != nil {
+			return err
 		}
 
-		return false, err
-	}
+		if opts.ImportLegacy {
+			if err := timescaleImportLegacy(ctx, conn, tableName); err != nil {
+				return fmt.Errorf("failed to import legacy data: %v", err)
+			}
+		}
 
-	var tableInit = func() error {
+		if isHypertable, err = timescaleSetupTable(ctx, db, tableName, opts); err != nil {
+			return err
+		}
 
-		query := fmt.Sprintf(`create table %s (
-			time timestamp with time zone not null,
-			label text not null,
-			probe_elapsed int8 not null,
-			probe_type text not null,
-			up boolean not null,
-			latency int8,
-			host text,
-			http_status int2,
-			tls_version int2
-		)`, tableName)
+		if opts.Rollups {
+			rollupTables, err = timescaleSetupRollups(ctx, db, tableName, isHypertable, opts)
+			return err
+		}
 
-		_, err := db.ExecContext(ctx, query)
-		return err
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	if exists, _ := tableExists(); !exists {
+	this := &timescaleStorage{
+		db:           db,
+		version:      version,
+		table:        tableName,
+		rollupTables: rollupTables,
+		done:         make(chan struct{}),
+	}
+
+	//	vanilla postgres doesn't have retention policies, so old rows have to be deleted manually.
+	//	the same goes for the rollup tables that are maintained by pulse
+	if opts.Retention != "" {
 
-		slog.Info("TIMESCALE: Setting up",
-			slog.String("table", tableName))
+		var pruned []timescalePruneTarget
 
-		if err := tableInit(); err != nil {
-			db.Close()
-			return nil, err
+		if !isHypertable {
+			pruned = append(pruned, timescalePruneTarget{Table: tableName, Column: "time"})
 		}
+
+		for _, target := range rollupTables {
+			pruned = append(pruned, timescalePruneTarget{Table: target.Name, Column: "bucket"})
+		}
+
+		if len(pruned) > 0 {
+			this.wg.Add(1)
+			go this.pruneLoop(opts.Retention, pruned)
+		}
+	}
+
+	if len(rollupTables) > 0 {
+
+		interval := opts.RollupInterval
+		if interval <= 0 {
+			interval = timescaleRollupInterval
+		}
+
+		this.wg.Add(1)
+		go this.rollupLoop(interval)
 	}
 
-	return &timescaleStorage{
-		db:      db,
-		version: version,
-		table:   tableName,
-	}, nil
+	return this, nil
 }
 
 type timescaleStorage struct {
 	db      *sql.DB
-	version string
+	version int
 	table   string
+
+	//	rollup tables that have to be refreshed by pulse
+	rollupTables []timescaleRollupTable
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	//	earliest timestamp of the entries written since the last rollup refresh
+	writtenMtx   sync.Mutex
+	writtenSince time.Time
 }
 
 // Returns client TypeID
@@ -86,13 +130,20 @@ func (this *timescaleStorage) Type() string {
 	return "timescale"
 }
 
-// Returns client version
+// Returns schema migration version
 func (this *timescaleStorage) Version() string {
-	return this.version
+	return strconv.Itoa(this.version)
+}
+
+// Batches are inserted in a single transaction
+func (this *timescaleStorage) AtomicBatches() bool {
+	return true
 }
 
 // Closes the database connections
 func (this *timescaleStorage) Close() error {
+	close(this.done)
+	this.wg.Wait()
 	return this.db.Close()
 }
 
@@ -103,8 +154,67 @@ func (this *timescaleStorage) Ping() error {
 // Writes a single uptime metric
 func (this *timescaleStorage) WriteUptime(ctx context.Context, entry UptimeEntry) error {
 
+	row, err := timescaleRow(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := sqlInsertContext(ctx, this.db, this.table, row); err != nil {
+		return timescaleError(err)
+	}
+
+	this.markWritten(entry.Timestamp)
+
+	return nil
+}
+
+// Writes multiple uptime metrics using multi-row inserts
+func (this *timescaleStorage) WriteUptimeBatch(ctx context.Context, entries []UptimeEntry) error {
+
+	var rows []map[string]any
+
+	for _, entry := range entries {
+
+		row, err := timescaleRow(entry)
+		if err != nil {
+			return err
+		}
+
+		rows = append(rows, row)
+	}
+
+	if err := sqlInsertBatchContext(ctx, this.db, this.table, rows, sqlMaxBindvars); err != nil {
+		return timescaleError(err)
+	}
+
+	for _, entry := range entries {
+		this.markWritten(entry.Timestamp)
+	}
+
+	return nil
+}
+
+// Marks connection, resource and concurrency errors as transient
+func timescaleError(err error) error {
+
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	//	08: connection exception, 40: transaction rollback, 53: insufficient resources, 57: operator intervention
+	switch pqErr.Code.Class() {
+	case "08", "40", "53", "57":
+		return &TransientError{Err: err}
+	}
+
+	return err
+}
+
+func timescaleRow(entry UptimeEntry) (map[string]any, error) {
+
 	if entry.Label == "" {
-		return errors.New("empty entry label")
+		return nil, errors.New("empty entry label")
 	}
 
 	if entry.Timestamp.IsZero() {
@@ -135,11 +245,49 @@ func (this *timescaleStorage) WriteUptime(ctx context.Context, entry UptimeEntry
 		row["host"] = *entry.Host
 	}
 
+	if entry.IpFamily != nil {
+		row["ip_family"] = *entry.IpFamily
+	}
+
 	if entry.TlsVersion != nil {
 		row["tls_version"] = *entry.TlsVersion
 	}
 
-	return sqlInsertContext(ctx, this.db, this.table, row)
+	if entry.HttpTimings != nil {
+		row["timing_dns"] = entry.HttpTimings.Dns.Milliseconds()
+		row["timing_connect"] = entry.HttpTimings.Connect.Milliseconds()
+		row["timing_tls"] = entry.HttpTimings.Tls.Milliseconds()
+		row["timing_ttfb"] = entry.HttpTimings.Ttfb.Milliseconds()
+		row["timing_transfer"] = entry.HttpTimings.Transfer.Milliseconds()
+	}
+
+	if entry.TlsCert != nil {
+		row["tls_cert_subject"] = entry.TlsCert.Subject
+		row["tls_cert_issuer"] = entry.TlsCert.Issuer
+		row["tls_cert_expires"] = entry.TlsCert.NotAfter
+		row["tls_cert_valid"] = entry.TlsCert.Valid
+	}
+
+	if entry.IcmpStats != nil {
+		row["icmp_sent"] = entry.IcmpStats.Sent
+		row["icmp_received"] = entry.IcmpStats.Received
+		row["icmp_loss"] = entry.IcmpStats.Loss
+		row["icmp_rtt_min"] = durationMillis(entry.IcmpStats.MinRtt)
+		row["icmp_rtt_avg"] = durationMillis(entry.IcmpStats.AvgRtt)
+		row["icmp_rtt_max"] = durationMillis(entry.IcmpStats.MaxRtt)
+		row["icmp_rtt_stddev"] = durationMillis(entry.IcmpStats.StdDevRtt)
+		row["icmp_jitter"] = durationMillis(entry.IcmpStats.Jitter)
+	}
+
+	if entry.Error != nil {
+		row["error"] = *entry.Error
+	}
+
+	if entry.FailureKind != nil {
+		row["failure_kind"] = string(*entry.FailureKind)
+	}
+
+	return row, nil
 }
 
 func sqlInsertContext(ctx context.Context, db *sql.DB, table string, row map[string]any) error {
@@ -164,3 +312,68 @@ func sqlInsertContext(ctx context.Context, db *sql.DB, table string, row map[str
 	_, err := db.ExecContext(ctx, query, args...)
 	return err
 }
+
+// Max number of bind parameters postgres allows in a single statement
+const sqlMaxBindvars = 65535
+
+// Inserts multiple rows using as few statements as possible, within the bind parameter limit of the database.
+// Columns that are missing from some of the rows are set to null
+func sqlInsertBatchContext(ctx context.Context, db *sql.DB, table string, rows []map[string]any, maxBindvars int) error {
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	columnSet := map[string]bool{}
+	for _, row := range rows {
+		for col := range row {
+			columnSet[col] = true
+		}
+	}
+
+	var columns []string
+	for col := range columnSet {
+		columns = append(columns, col)
+	}
+
+	sort.Strings(columns)
+
+	chunkSize := maxBindvars / len(columns)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for len(rows) > 0 {
+
+		chunk := rows[:min(chunkSize, len(rows))]
+		rows = rows[len(chunk):]
+
+		var args []any
+		var values []string
+
+		for _, row := range chunk {
+
+			var bindvars []string
+			for _, col := range columns {
+				args = append(args, row[col])
+				bindvars = append(bindvars, "$"+strconv.Itoa(len(args)))
+			}
+
+			values = append(values, "("+strings.Join(bindvars, ", ")+")")
+		}
+
+		query := fmt.Sprintf("insert into %s (%s) values %s",
+			table,
+			strings.Join(columns, ", "),
+			strings.Join(values, ", "))
+
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,292 @@
+package pulse
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Advisory lock key that prevents multiple pulse instances from migrating the schema at the same time ("pulse" in ascii)
+const timescaleMigrationLock = 0x70756c7365
+
+// Table used to track the applied migrations
+const timescaleMigrationsTable = "pulse_migrations"
+
+// Table used to track data imports from the legacy tables
+const timescaleImportsTable = "pulse_imports"
+
+// Legacy table that was created by the previous versions
+const timescaleLegacyTable = "pulse_uptime_v2"
+
+// Schema migrations, in the order they're applied. Existing migrations must never be changed or reordered,
+// add new ones to the end of the list instead
+var timescaleMigrations = []schemaMigration{
+	{
+		Name: "create_uptime_table",
+		Statements: []string{
+			//	the legacy table is adopted as is, and a view is left in its place to keep the existing queries working
+			`do $$
+			begin
+				if to_regclass('pulse_uptime') is null and to_regclass('pulse_uptime_v2') is not null then
+					alter table pulse_uptime_v2 rename to pulse_uptime;
+					create view pulse_uptime_v2 as select * from pulse_uptime;
+				end if;
+			end
+			$$`,
+			`create table if not exists pulse_uptime (
+				time timestamp with time zone not null,
+				label text not null,
+				probe_elapsed int8 not null,
+				probe_type text not null,
+				up boolean not null,
+				latency int8,
+				host text,
+				http_status int2,
+				tls_version int2
+			)`,
+		},
+	},
+	{
+		Name: "add_label_time_index",
+		Statements: []string{
+			`create index if not exists pulse_uptime_label_time_idx on pulse_uptime (label, time desc)`,
+		},
+	},
+	{
+		Name: "add_http_timings",
+		Statements: []string{
+			`alter table pulse_uptime
+				add column if not exists timing_dns int8,
+				add column if not exists timing_connect int8,
+				add column if not exists timing_tls int8,
+				add column if not exists timing_ttfb int8,
+				add column if not exists timing_transfer int8`,
+		},
+	},
+	{
+		Name: "add_tls_cert",
+		Statements: []string{
+			`alter table pulse_uptime
+				add column if not exists tls_cert_subject text,
+				add column if not exists tls_cert_issuer text,
+				add column if not exists tls_cert_expires timestamp with time zone,
+				add column if not exists tls_cert_valid boolean`,
+		},
+	},
+	{
+		Name: "add_failure_reason",
+		Statements: []string{
+			`alter table pulse_uptime
+				add column if not exists error text,
+				add column if not exists failure_kind text`,
+		},
+	},
+	{
+		Name: "add_icmp_stats",
+		Statements: []string{
+			`alter table pulse_uptime
+				add column if not exists icmp_sent int2,
+				add column if not exists icmp_received int2,
+				add column if not exists icmp_loss real,
+				add column if not exists icmp_rtt_min double precision,
+				add column if not exists icmp_rtt_avg double precision,
+				add column if not exists icmp_rtt_max double precision,
+				add column if not exists icmp_rtt_stddev double precision,
+				add column if not exists icmp_jitter double precision`,
+		},
+	},
+	{
+		Name: "add_ip_family",
+		Statements: []string{
+			`alter table pulse_uptime add column if not exists ip_family text`,
+		},
+	},
+}
+
+// Runs the callback while holding the migration lock.
+// The lock is bound to a database session, so a dedicated connection is kept open until the callback returns
+func timescaleWithLock(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "select pg_advisory_lock($1)", timescaleMigrationLock); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %v", err)
+	}
+
+	defer conn.ExecContext(context.Background(), "select pg_advisory_unlock($1)", timescaleMigrationLock)
+
+	return fn(conn)
+}
+
+// Applies pending migrations and returns the current schema version
+func timescaleMigrate(ctx context.Context, conn *sql.Conn) (int, error) {
+
+	query := fmt.Sprintf(`create table if not exists %s (
+		id int4 primary key,
+		name text not null,
+		applied_at timestamp with time zone not null default now()
+	)`, timescaleMigrationsTable)
+
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return 0, fmt.Errorf("failed to create migrations table: %v", err)
+	}
+
+	var version int
+	query = fmt.Sprintf("select coalesce(max(id), 0) from %s", timescaleMigrationsTable)
+	if err := conn.QueryRowContext(ctx, query).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %v", err)
+	}
+
+	if version > len(timescaleMigrations) {
+		return version, fmt.Errorf("database schema version %d is newer than the supported %d", version, len(timescaleMigrations))
+	}
+
+	for idx := version; idx < len(timescaleMigrations); idx++ {
+
+		migration := timescaleMigrations[idx]
+		id := idx + 1
+
+		slog.Info("TIMESCALE: Applying migration",
+			slog.Int("id", id),
+			slog.String("name", migration.Name))
+
+		if err := timescaleApplyMigration(ctx, conn, id, migration); err != nil {
+			return version, fmt.Errorf("migration %d (%s): %v", id, migration.Name, err)
+		}
+
+		version = id
+	}
+
+	return version, nil
+}
+
+func timescaleApplyMigration(ctx context.Context, conn *sql.Conn, id int, migration schemaMigration) error {
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range migration.Statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	query := fmt.Sprintf("insert into %s (id, name) values ($1, $2)", timescaleMigrationsTable)
+	if _, err := tx.ExecContext(ctx, query, id, migration.Name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Copies rows from the legacy table into the current one. The import is only done once
+func timescaleImportLegacy(ctx context.Context, conn *sql.Conn, table string) error {
+
+	//	the legacy table is replaced with a view when it's adopted by the first migration, there's nothing to import then
+	var exists bool
+	query := "select coalesce((select relkind in ('r', 'p') from pg_class where oid = to_regclass($1)), false)"
+	if err := conn.QueryRowContext(ctx, query, timescaleLegacyTable).Scan(&exists); err != nil {
+		return err
+	}
+
+	if !exists {
+		slog.Info("TIMESCALE: Nothing to import, legacy table doesn't exist",
+			slog.String("table", timescaleLegacyTable))
+		return nil
+	}
+
+	query = fmt.Sprintf(`create table if not exists %s (
+		source text primary key,
+		row_count int8 not null,
+		imported_at timestamp with time zone not null default now()
+	)`, timescaleImportsTable)
+
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create imports table: %v", err)
+	}
+
+	var imported bool
+	query = fmt.Sprintf("select exists (select 1 from %s where source = $1)", timescaleImportsTable)
+	if err := conn.QueryRowContext(ctx, query, timescaleLegacyTable).Scan(&imported); err != nil {
+		return err
+	}
+
+	if imported {
+		return nil
+	}
+
+	//	the set of columns depends on the version that has last written to the table
+	rows, err := conn.QueryContext(ctx, `select column_name from information_schema.columns
+		where table_schema = current_schema() and table_name = $1
+		intersect
+		select column_name from information_schema.columns
+		where table_schema = current_schema() and table_name = $2
+		order by 1`, timescaleLegacyTable, table)
+	if err != nil {
+		return err
+	}
+
+	var columns []string
+
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			rows.Close()
+			return err
+		}
+		columns = append(columns, col)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(columns) == 0 {
+		return fmt.Errorf("no matching columns")
+	}
+
+	slog.Info("TIMESCALE: Importing legacy data",
+		slog.String("from", timescaleLegacyTable),
+		slog.String("to", table))
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	columnList := strings.Join(columns, ", ")
+
+	query = fmt.Sprintf("insert into %s (%s) select %s from %s", table, columnList, columnList, timescaleLegacyTable)
+	result, err := tx.ExecContext(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	count, _ := result.RowsAffected()
+
+	query = fmt.Sprintf("insert into %s (source, row_count) values ($1, $2)", timescaleImportsTable)
+	if _, err := tx.ExecContext(ctx, query, timescaleLegacyTable, count); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	slog.Info("TIMESCALE: Legacy data imported",
+		slog.Int64("rows", count))
+
+	return nil
+}
@@ -0,0 +1,406 @@
+package pulse
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Pre-aggregated uptime stats, exposed as a table or a view named after the rollup.
+//
+// With timescaledb, the counters and the latency averages are kept in a continuous aggregate. Percentiles are ordered-set aggregates,
+// which continuous aggregates can't handle, so these go to a separate table that pulse refreshes by itself.
+// On vanilla postgres, all of the stats are kept in a single table that is refreshed by pulse
+type timescaleRollup struct {
+	Table string
+	//	date_trunc() precision. Buckets are always aligned to UTC, regardless of the session time zone
+	Unit string
+	//	How far back the buckets are recomputed on every refresh, to catch up with the entries that came in late
+	Lookback string
+}
+
+var timescaleRollups = []timescaleRollup{
+	{Table: "pulse_uptime_hourly", Unit: "hour", Lookback: "1 hour"},
+	{Table: "pulse_uptime_daily", Unit: "day", Lookback: "1 day"},
+}
+
+// Name of the continuous aggregate that holds the rollup counters
+func (this timescaleRollup) statsTable() string {
+	return this.Table + "_stats"
+}
+
+// Name of the table that holds the rollup percentiles when the counters are in a continuous aggregate
+func (this timescaleRollup) latencyTable() string {
+	return this.Table + "_latency"
+}
+
+type timescaleRollupColumn struct {
+	Name string
+	Type string
+	//	Aggregate expression over the raw table
+	Expr string
+}
+
+var timescaleRollupStatsColumns = []timescaleRollupColumn{
+	{Name: "samples", Type: "int8 not null", Expr: "count(*)"},
+	{Name: "up_samples", Type: "int8 not null", Expr: "sum(up::int)"},
+	{Name: "uptime_ratio", Type: "double precision not null", Expr: "avg(up::int)"},
+	{Name: "latency_avg", Type: "double precision", Expr: "avg(latency)"},
+	{Name: "latency_min", Type: "int8", Expr: "min(latency)"},
+	{Name: "latency_max", Type: "int8", Expr: "max(latency)"},
+}
+
+var timescaleRollupLatencyColumns = []timescaleRollupColumn{
+	{Name: "latency_p50", Type: "double precision", Expr: "percentile_cont(0.5) within group (order by latency::double precision)"},
+	{Name: "latency_p95", Type: "double precision", Expr: "percentile_cont(0.95) within group (order by latency::double precision)"},
+	{Name: "latency_p99", Type: "double precision", Expr: "percentile_cont(0.99) within group (order by latency::double precision)"},
+}
+
+// Rollup table that is refreshed by pulse
+type timescaleRollupTable struct {
+	timescaleRollup
+	Name    string
+	Columns []timescaleRollupColumn
+}
+
+// Creates the rollup tables and views. Returns the tables that have to be refreshed by pulse
+func timescaleSetupRollups(ctx context.Context, db *sql.DB, table string, isHypertable bool, opts TimescaleOptions) ([]timescaleRollupTable, error) {
+
+	//	hypertables already have one, but refreshes on vanilla postgres would have to scan the whole table without it
+	if !isHypertable {
+		query := fmt.Sprintf("create index if not exists %s_time_idx on %s (time desc)", table, table)
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("failed to create time index: %v", err)
+		}
+	}
+
+	var refreshed []timescaleRollupTable
+
+	for _, rollup := range timescaleRollups {
+
+		if !isHypertable {
+
+			target := timescaleRollupTable{
+				timescaleRollup: rollup,
+				Name:            rollup.Table,
+				Columns:         append(append([]timescaleRollupColumn(nil), timescaleRollupStatsColumns...), timescaleRollupLatencyColumns...),
+			}
+
+			if err := timescaleSetupRollupTable(ctx, db, target); err != nil {
+				return nil, err
+			}
+
+			refreshed = append(refreshed, target)
+			continue
+		}
+
+		target := timescaleRollupTable{
+			timescaleRollup: rollup,
+			Name:            rollup.latencyTable(),
+			Columns:         timescaleRollupLatencyColumns,
+		}
+
+		if err := timescaleSetupAggregate(ctx, db, table, rollup, opts); err != nil {
+			return nil, err
+		}
+
+		if err := timescaleSetupRollupTable(ctx, db, target); err != nil {
+			return nil, err
+		}
+
+		if err := timescaleSetupRollupView(ctx, db, rollup); err != nil {
+			return nil, err
+		}
+
+		refreshed = append(refreshed, target)
+	}
+
+	return refreshed, nil
+}
+
+func timescaleSetupRollupTable(ctx context.Context, db *sql.DB, target timescaleRollupTable) error {
+
+	query := fmt.Sprintf(`create table if not exists %s (
+			bucket timestamp with time zone not null,
+			label text not null,
+			probe_type text not null,
+			ip_family text not null,
+			primary key (label, probe_type, ip_family, bucket)
+		)`, target.Name)
+
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create rollup table %s: %v", target.Name, err)
+	}
+
+	//	tables created by the older versions may be missing some of the columns
+	for _, col := range target.Columns {
+		query := fmt.Sprintf("alter table %s add column if not exists %s %s", target.Name, col.Name, col.Type)
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to add column %s to rollup table %s: %v", col.Name, target.Name, err)
+		}
+	}
+
+	//	older versions used the session time zone for the buckets,
+	//	such tables are emptied to get backfilled with the utc-aligned buckets
+	var misaligned bool
+	query = fmt.Sprintf("select exists (select 1 from %s where bucket <> date_trunc($1, bucket at time zone 'UTC') at time zone 'UTC')", target.Name)
+	if err := db.QueryRowContext(ctx, query, target.Unit).Scan(&misaligned); err != nil {
+		return fmt.Errorf("failed to check rollup table %s: %v", target.Name, err)
+	}
+
+	if misaligned {
+
+		slog.Info("TIMESCALE: Rebuilding rollup table with UTC buckets",
+			slog.String("table", target.Name))
+
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("truncate %s", target.Name)); err != nil {
+			return fmt.Errorf("failed to clear rollup table %s: %v", target.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Creates the continuous aggregate with the rollup counters and sets up its refresh and retention policies
+func timescaleSetupAggregate(ctx context.Context, db *sql.DB, table string, rollup timescaleRollup, opts TimescaleOptions) error {
+
+	//	older versions kept the whole rollup in a plain table under the name that is now taken by the view.
+	//	it only has the data that can be recomputed from the raw table, so it's dropped
+	var relkind string
+	err := db.QueryRowContext(ctx, "select coalesce((select relkind::text from pg_class where oid = to_regclass($1)), '')", rollup.Table).Scan(&relkind)
+	if err != nil {
+		return fmt.Errorf("failed to check rollup %s: %v", rollup.Table, err)
+	}
+
+	if relkind == "r" {
+
+		slog.Info("TIMESCALE: Replacing rollup table with a continuous aggregate",
+			slog.String("table", rollup.Table))
+
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("drop table %s", rollup.Table)); err != nil {
+			return fmt.Errorf("failed to drop rollup table %s: %v", rollup.Table, err)
+		}
+	}
+
+	var columns []string
+	for _, col := range timescaleRollupStatsColumns {
+		columns = append(columns, col.Expr+" as "+col.Name)
+	}
+
+	//	1 hour and 1 day buckets are aligned to UTC by time_bucket(), same as the date_trunc() ones.
+	//	with real-time aggregation, the buckets that haven't been materialized yet are computed on the fly
+	query := fmt.Sprintf(`create materialized view if not exists %s
+		with (timescaledb.continuous, timescaledb.materialized_only = false) as
+		select
+			time_bucket(interval '1 %s', time) as bucket,
+			label,
+			probe_type,
+			ip_family,
+			%s
+		from %s
+		group by time_bucket(interval '1 %s', time), label, probe_type, ip_family
+		with no data`,
+		rollup.statsTable(), rollup.Unit, strings.Join(columns, ",\n\t\t\t"), table, rollup.Unit)
+
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create continuous aggregate %s: %v", rollup.statsTable(), err)
+	}
+
+	interval := opts.RollupInterval
+	if interval <= 0 {
+		interval = timescaleRollupInterval
+	}
+
+	//	policies are replaced to make sure that the updated options are applied.
+	//	the refresh window is unbounded to pick up delayed entries, timescale only recomputes the buckets that have changed
+	if _, err := db.ExecContext(ctx, "select remove_continuous_aggregate_policy($1::regclass, if_exists => true)", rollup.statsTable()); err != nil {
+		return fmt.Errorf("failed to remove refresh policy: %v", err)
+	}
+
+	query = "select add_continuous_aggregate_policy($1::regclass, start_offset => null, end_offset => $2::interval, schedule_interval => make_interval(secs => $3))"
+	if _, err := db.ExecContext(ctx, query, rollup.statsTable(), "1 "+rollup.Unit, interval.Seconds()); err != nil {
+		return fmt.Errorf("failed to add refresh policy: %v", err)
+	}
+
+	if opts.Retention != "" {
+
+		if _, err := db.ExecContext(ctx, "select remove_retention_policy($1::regclass, if_exists => true)", rollup.statsTable()); err != nil {
+			return fmt.Errorf("failed to remove retention policy: %v", err)
+		}
+
+		if _, err := db.ExecContext(ctx, "select add_retention_policy($1::regclass, $2::interval)", rollup.statsTable(), opts.Retention); err != nil {
+			return fmt.Errorf("failed to add retention policy: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Joins the continuous aggregate with the percentiles, so that the rollup has the same columns as on vanilla postgres
+func timescaleSetupRollupView(ctx context.Context, db *sql.DB, rollup timescaleRollup) error {
+
+	query := fmt.Sprintf(`create or replace view %s as
+		select
+			stats.bucket,
+			stats.label,
+			stats.probe_type,
+			coalesce(stats.ip_family, '') as ip_family,
+			stats.samples,
+			stats.up_samples,
+			stats.uptime_ratio::double precision as uptime_ratio,
+			stats.latency_avg::double precision as latency_avg,
+			stats.latency_min,
+			stats.latency_max,
+			latency.latency_p50,
+			latency.latency_p95,
+			latency.latency_p99
+		from %s as stats
+		left join %s as latency on
+			latency.bucket = stats.bucket and
+			latency.label = stats.label and
+			latency.probe_type = stats.probe_type and
+			latency.ip_family = coalesce(stats.ip_family, '')`,
+		rollup.Table, rollup.statsTable(), rollup.latencyTable())
+
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create rollup view %s: %v", rollup.Table, err)
+	}
+
+	return nil
+}
+
+// Recomputes the recent buckets of a rollup table, as well as the ones starting with writtenSince,
+// which is the earliest timestamp of the entries written since the last refresh. An empty table is backfilled from all of the available data
+func timescaleRefreshRollup(ctx context.Context, db *sql.DB, table string, target timescaleRollupTable, writtenSince time.Time) (int64, error) {
+
+	var isEmpty bool
+	query := fmt.Sprintf("select not exists (select 1 from %s)", target.Name)
+	if err := db.QueryRowContext(ctx, query).Scan(&isEmpty); err != nil {
+		return 0, err
+	}
+
+	since := time.Unix(0, 0)
+
+	if !isEmpty {
+		if err := db.QueryRowContext(ctx, "select date_trunc($1, now() at time zone 'UTC') at time zone 'UTC' - $2::interval", target.Unit, target.Lookback).Scan(&since); err != nil {
+			return 0, err
+		}
+	}
+
+	//	delayed entries, like the ones replayed from the write buffer, would be missed otherwise
+	if !writtenSince.IsZero() && writtenSince.Before(since) {
+		query := "select date_trunc($1, $2::timestamptz at time zone 'UTC') at time zone 'UTC'"
+		if err := db.QueryRowContext(ctx, query, target.Unit, writtenSince).Scan(&since); err != nil {
+			return 0, err
+		}
+	}
+
+	var names, exprs, updates []string
+	for _, col := range target.Columns {
+		names = append(names, col.Name)
+		exprs = append(exprs, col.Expr)
+		updates = append(updates, col.Name+" = excluded."+col.Name)
+	}
+
+	query = fmt.Sprintf(`insert into %s (
+			bucket,
+			label,
+			probe_type,
+			ip_family,
+			%s
+		)
+		select
+			date_trunc('%s', time at time zone 'UTC') at time zone 'UTC' as bucket,
+			label,
+			probe_type,
+			coalesce(ip_family, '') as ip_family,
+			%s
+		from %s
+		where time >= $1
+		group by 1, 2, 3, 4
+		on conflict (label, probe_type, ip_family, bucket) do update set
+			%s`,
+		target.Name,
+		strings.Join(names, ",\n\t\t\t"),
+		target.Unit,
+		strings.Join(exprs, ",\n\t\t\t"),
+		table,
+		strings.Join(updates, ",\n\t\t\t"))
+
+	result, err := db.ExecContext(ctx, query, since)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (this *timescaleStorage) rollupLoop(interval time.Duration) {
+
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+
+		writtenSince := this.takeWrittenSince()
+
+		for _, target := range this.rollupTables {
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			buckets, err := timescaleRefreshRollup(ctx, this.db, this.table, target, writtenSince)
+			cancel()
+
+			if err != nil {
+
+				slog.Error("TIMESCALE: Failed to refresh rollup",
+					slog.String("table", target.Name),
+					slog.String("err", err.Error()))
+
+				//	so that the next refresh picks the delayed entries up
+				this.markWritten(writtenSince)
+				continue
+			}
+
+			slog.Debug("TIMESCALE: Rollup refreshed",
+				slog.String("table", target.Name),
+				slog.Int64("buckets", buckets))
+		}
+
+		select {
+		case <-this.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Keeps track of the earliest entry timestamp written since the last rollup refresh
+func (this *timescaleStorage) markWritten(timestamp time.Time) {
+
+	if timestamp.IsZero() {
+		return
+	}
+
+	this.writtenMtx.Lock()
+	defer this.writtenMtx.Unlock()
+
+	if this.writtenSince.IsZero() || timestamp.Before(this.writtenSince) {
+		this.writtenSince = timestamp
+	}
+}
+
+func (this *timescaleStorage) takeWrittenSince() time.Time {
+
+	this.writtenMtx.Lock()
+	defer this.writtenMtx.Unlock()
+
+	val := this.writtenSince
+	this.writtenSince = time.Time{}
+
+	return val
+}
@@ -0,0 +1,160 @@
+package pulse
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+type TimescaleOptions struct {
+	//	Deletes data older than this interval, in postgres interval format ('90 days', '1 year')
+	Retention string
+	//	Compresses chunks older than this interval (timescaledb only)
+	CompressAfter string
+	//	Copies the data from the pulse_uptime_v2 table created by the older versions
+	ImportLegacy bool
+	//	Maintains hourly and daily uptime rollup tables
+	Rollups bool
+	//	How often the rollups are refreshed (defaults to 5m)
+	RollupInterval time.Duration
+}
+
+// How often old rows are deleted when running on vanilla postgres
+const timescalePruneInterval = time.Hour
+
+// Default rollup refresh interval
+const timescaleRollupInterval = 5 * time.Minute
+
+// Table that has its old rows deleted by pulse
+type timescalePruneTarget struct {
+	Table string
+	//	Timestamp column that is compared to the retention interval
+	Column string
+}
+
+// Checks whether the timescaledb extension is installed in the current database
+func timescaleHasExtension(ctx context.Context, db *sql.DB) (bool, error) {
+
+	var exists bool
+	err := db.QueryRowContext(ctx, "select exists (select 1 from pg_extension where extname = 'timescaledb')").Scan(&exists)
+	return exists, err
+}
+
+// If timescaledb is available, converts the table to a hypertable and applies the policies.
+// All of the steps are safe to run on every startup
+func timescaleSetupTable(ctx context.Context, db *sql.DB, table string, opts TimescaleOptions) (bool, error) {
+
+	for _, val := range []string{opts.Retention, opts.CompressAfter} {
+		if val == "" {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, "select $1::interval", val); err != nil {
+			return false, fmt.Errorf("invalid interval '%s': %v", val, err)
+		}
+	}
+
+	hasTimescale, err := timescaleHasExtension(ctx, db)
+	if err != nil {
+		return false, fmt.Errorf("failed to check timescaledb extension: %v", err)
+	}
+
+	if !hasTimescale {
+
+		slog.Info("TIMESCALE: Extension not installed, using a plain postgres table",
+			slog.String("table", table))
+
+		if opts.CompressAfter != "" {
+			slog.Warn("TIMESCALE: Compression requires the timescaledb extension, ignoring the option")
+		}
+
+		return false, nil
+	}
+
+	//	migrate_data is required for tables that already have rows in them
+	if _, err := db.ExecContext(ctx, "select create_hypertable($1::regclass, 'time', if_not_exists => true, migrate_data => true)", table); err != nil {
+		return false, fmt.Errorf("failed to create hypertable: %v", err)
+	}
+
+	//	policies are replaced to make sure that the updated options are applied
+	if opts.Retention != "" {
+
+		if _, err := db.ExecContext(ctx, "select remove_retention_policy($1::regclass, if_exists => true)", table); err != nil {
+			return true, fmt.Errorf("failed to remove retention policy: %v", err)
+		}
+
+		if _, err := db.ExecContext(ctx, "select add_retention_policy($1::regclass, $2::interval)", table, opts.Retention); err != nil {
+			return true, fmt.Errorf("failed to add retention policy: %v", err)
+		}
+	}
+
+	if opts.CompressAfter != "" {
+
+		var compressionEnabled bool
+		err := db.QueryRowContext(ctx, "select compression_enabled from timescaledb_information.hypertables where hypertable_name = $1", table).
+			Scan(&compressionEnabled)
+		if err != nil {
+			return true, fmt.Errorf("failed to check compression settings: %v", err)
+		}
+
+		//	compression settings can't be altered once there are compressed chunks
+		if !compressionEnabled {
+			query := fmt.Sprintf("alter table %s set (timescaledb.compress, timescaledb.compress_segmentby = 'label', timescaledb.compress_orderby = 'time desc')", table)
+			if _, err := db.ExecContext(ctx, query); err != nil {
+				return true, fmt.Errorf("failed to enable compression: %v", err)
+			}
+		}
+
+		if _, err := db.ExecContext(ctx, "select remove_compression_policy($1::regclass, if_exists => true)", table); err != nil {
+			return true, fmt.Errorf("failed to remove compression policy: %v", err)
+		}
+
+		if _, err := db.ExecContext(ctx, "select add_compression_policy($1::regclass, $2::interval)", table, opts.CompressAfter); err != nil {
+			return true, fmt.Errorf("failed to add compression policy: %v", err)
+		}
+	}
+
+	slog.Info("TIMESCALE: Hypertable ready",
+		slog.String("table", table),
+		slog.String("retention", opts.Retention),
+		slog.String("compress_after", opts.CompressAfter))
+
+	return true, nil
+}
+
+// Deletes rows that are older than the retention interval; only used for the tables that the timescaledb policies don't apply to
+func (this *timescaleStorage) pruneLoop(retention string, targets []timescalePruneTarget) {
+
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(timescalePruneInterval)
+	defer ticker.Stop()
+
+	for {
+
+		for _, target := range targets {
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			query := fmt.Sprintf("delete from %s where %s < now() - $1::interval", target.Table, target.Column)
+			result, err := this.db.ExecContext(ctx, query, retention)
+			cancel()
+
+			if err != nil {
+				slog.Error("TIMESCALE: Failed to delete old rows",
+					slog.String("table", target.Table),
+					slog.String("err", err.Error()))
+			} else if deleted, _ := result.RowsAffected(); deleted > 0 {
+				slog.Debug("TIMESCALE: Deleted old rows",
+					slog.String("table", target.Table),
+					slog.Int64("count", deleted))
+			}
+		}
+
+		select {
+		case <-this.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
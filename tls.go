@@ -0,0 +1,209 @@
+package pulse
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+type TlsOptions struct {
+	//	Whether to verify server certificates (defaults to true)
+	Verify *bool `yaml:"verify" json:"verify"`
+	//	PEM bundle with CA certificates to use instead of system roots
+	CaFile string `yaml:"ca_file" json:"ca_file"`
+	//	Overrides the server name used for SNI and certificate verification
+	ServerName string `yaml:"server_name" json:"server_name"`
+	//	Minimal TLS version: 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `yaml:"min_version" json:"min_version"`
+	//	Maximal TLS version: 1.0, 1.1, 1.2 or 1.3
+	MaxVersion string `yaml:"max_version" json:"max_version"`
+	//	PEM client certificate for mTLS
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	//	PEM client certificate key for mTLS
+	KeyFile string `yaml:"key_file" json:"key_file"`
+}
+
+// Creates a client tls config. Nil options result in a default config with verification enabled
+func (this *TlsOptions) Config() (*tls.Config, error) {
+
+	config := tls.Config{}
+
+	if this == nil {
+		return &config, nil
+	}
+
+	if this.Verify != nil && !*this.Verify {
+		config.InsecureSkipVerify = true
+	}
+
+	config.ServerName = this.ServerName
+
+	if this.CaFile != "" {
+
+		data, err := os.ReadFile(this.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("ca_file: no certificates found")
+		}
+
+		config.RootCAs = pool
+	}
+
+	var err error
+
+	if config.MinVersion, err = parseTlsVersion(this.MinVersion); err != nil {
+		return nil, fmt.Errorf("min_version: %v", err)
+	}
+
+	if config.MaxVersion, err = parseTlsVersion(this.MaxVersion); err != nil {
+		return nil, fmt.Errorf("max_version: %v", err)
+	}
+
+	if config.MinVersion != 0 && config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+		return nil, errors.New("min_version is greater than max_version")
+	}
+
+	switch {
+
+	case this.CertFile != "" && this.KeyFile != "":
+
+		cert, err := tls.LoadX509KeyPair(this.CertFile, this.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+
+	case this.CertFile != "" || this.KeyFile != "":
+		return nil, errors.New("both cert_file and key_file must be set")
+	}
+
+	return &config, nil
+}
+
+func parseTlsVersion(val string) (uint16, error) {
+
+	switch strings.TrimPrefix(strings.ToLower(val), "tls") {
+	case "":
+		return 0, nil
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported tls version '%s'", val)
+	}
+}
+
+// Wraps a request error that has happened during the tls handshake
+type tlsHandshakeError struct {
+	Err error
+}
+
+func (this *tlsHandshakeError) Error() string {
+	return this.Err.Error()
+}
+
+func (this *tlsHandshakeError) Unwrap() error {
+	return this.Err
+}
+
+// Checks if the error is a tls alert sent by the remote.
+// crypto/tls reports these as net.OpError, while tls.AlertError is only used with quic
+func isTlsAlertError(err error) bool {
+
+	var alertErr tls.AlertError
+	if errors.As(err, &alertErr) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
+
+// Checks if the error was caused by the server certificate being rejected
+func isTlsVerifyError(err error) bool {
+
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	return errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+// Extracts leaf certificate details and checks the chain against the provided roots (or system roots when nil)
+func inspectTlsCert(state *tls.ConnectionState, roots *x509.CertPool) *TlsCertInfo {
+
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	leaf := state.PeerCertificates[0]
+
+	info := TlsCertInfo{
+		Subject:  leaf.Subject.String(),
+		Issuer:   leaf.Issuer.String(),
+		DnsNames: leaf.DNSNames,
+		NotAfter: leaf.NotAfter,
+		//	rounded down, so that an expired certificate has a negative value even on the day it has expired
+		DaysLeft: int(math.Floor(time.Until(leaf.NotAfter).Hours() / 24)),
+	}
+
+	if roots == nil {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return &info
+		}
+		roots = pool
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+
+	info.Valid = err == nil
+
+	return &info
+}
+
+func extractTlsVersion(version uint16) int {
+	switch version {
+	case tls.VersionSSL30:
+		return 300
+	case tls.VersionTLS10:
+		return 100
+	case tls.VersionTLS11:
+		return 110
+	case tls.VersionTLS12:
+		return 120
+	case tls.VersionTLS13:
+		return 130
+	default:
+		return int(version)
+	}
+}